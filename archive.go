@@ -0,0 +1,355 @@
+// Copyright 2014 The DevMine Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// archiveNameRegexp matches the name of a GHTorrent MongoDB dump archive, such
+// as mongo-dump-2014-01-02.tar.gz. The archive may be compressed using any of
+// the compression formats supported for BSON dumps.
+var archiveNameRegexp = regexp.MustCompile(`^mongo-dump-([0-9]{4}-[0-9]{2}-[0-9]{2})\.tar(\.gz|\.bz2|\.xz|\.zst)?$`)
+
+// archiveDate returns the creation date of the archive named name.
+func archiveDate(name string) (time.Time, error) {
+	m := archiveNameRegexp.FindStringSubmatch(name)
+	if m == nil {
+		return time.Time{}, errors.New("invalid archive name " + name)
+	}
+	return time.Parse("2006-01-02", m[1])
+}
+
+// An archiveList is a sortable list of paths to archives. They are sorted by
+// the date present in the archive name, in the same order as BSON dumps in
+// entity folders.
+type archiveList []string
+
+func (al archiveList) Len() int {
+	return len(al)
+}
+
+func (al archiveList) Swap(i, j int) {
+	al[i], al[j] = al[j], al[i]
+}
+
+func (al archiveList) Less(i, j int) bool {
+	di, err := archiveDate(filepath.Base(al[i]))
+	if err != nil {
+		// this should never happen since archives names are checked first
+		fail(err)
+		return false
+	}
+
+	dj, err := archiveDate(filepath.Base(al[j]))
+	if err != nil {
+		// this should never happen since archives names are checked first
+		fail(err)
+		return false
+	}
+
+	return dumpBefore(di, dj)
+}
+
+// memberEntity returns the GitHub entity corresponding to the tar archive
+// member named name, or an empty string if the member is not a BSON
+// collection.
+//
+// Collections are stored as dump/github/<entity>.bson in GHTorrent archives.
+func memberEntity(name string) string {
+	base := path.Base(name)
+	if !strings.HasSuffix(base, ".bson") {
+		return ""
+	}
+	return strings.TrimSuffix(base, ".bson")
+}
+
+// visitArchives schedules the import of the BSON collections contained in
+// the GHTorrent archives found at paths, in the same order as BSON dumps.
+// Archives outside of the range of dates given on the command line are
+// skipped.
+//
+// Since the collections of an archive are only known once it is read, the
+// import of every entity is scheduled, and entities whose collection the
+// archive does not contain are skipped when it is read (see importEntity).
+func visitArchives(s *scheduler, paths []string) error {
+	var al archiveList
+	for _, p := range paths {
+		date, err := archiveDate(filepath.Base(p))
+		if err != nil {
+			return err
+		}
+		if !inDateRange(date) {
+			fmt.Printf("skipped archive '%s': out of date range\n", p)
+			continue
+		}
+		al = append(al, p)
+	}
+	sort.Sort(al)
+
+	for _, p := range al {
+		date, err := archiveDate(filepath.Base(p))
+		if err != nil {
+			return err
+		}
+
+		a := newArchive(p, date)
+		for _, entity := range entities {
+			entity := entity
+			s.add(entity, func() {
+				if err := a.importEntity(entity); err != nil {
+					fail(fmt.Sprintf("failed to import archive '%s': %v", a.path, err))
+					importFailed(err)
+				}
+			})
+		}
+	}
+
+	return nil
+}
+
+// archive is a GHTorrent archive whose collections are imported one entity
+// at a time.
+//
+// A tar archive can only be read sequentially, and its collections are
+// stored in any order, so the archive is read and decompressed once, by the
+// first of its imports to run (see walk). The collection of the entity of
+// this import is imported as it is read, while the collections of the other
+// entities, which may depend on entities that are not imported yet, are
+// spooled to disk until their own import runs.
+type archive struct {
+	path     string
+	date     time.Time
+	checksum string // see fileChecksum
+
+	// walker elects the import reading the archive.
+	walker sync.Once
+
+	// members holds the collections of the archive by entity. Its keys are
+	// set by newArchive, the members being filled by the import reading the
+	// archive.
+	members map[string]*archiveMember
+
+	// spool is the directory where collections are spooled.
+	spool string
+
+	// importMember imports a collection of the archive read from r.
+	importMember func(entity string, m *archiveMember, r io.Reader)
+}
+
+// archiveMember is the BSON collection of an entity in an archive.
+type archiveMember struct {
+	name  string      // name of the collection, as in reports
+	cp    *checkpoint // nil in dry-run mode
+	spool string      // spooled collection, if any
+
+	// ready is closed once the collection has been spooled, or once it is
+	// known that there is nothing to import.
+	ready chan struct{}
+}
+
+// newArchive returns the archive at path, created at the given date.
+func newArchive(path string, date time.Time) *archive {
+	a := &archive{
+		path:         path,
+		date:         date,
+		members:      make(map[string]*archiveMember),
+		importMember: importArchiveMember,
+	}
+	for _, entity := range entities {
+		a.members[entity] = &archiveMember{ready: make(chan struct{})}
+	}
+	return a
+}
+
+// importEntity imports the BSON collection of the archive corresponding to
+// the given GitHub entity, unless it has already been imported or the
+// archive does not contain it.
+//
+// The first import to run reads the archive and returns the errors that
+// occur while doing so. The following ones wait for their collection to be
+// spooled, import it and remove it.
+func (a *archive) importEntity(entity string) error {
+	walker := false
+	a.walker.Do(func() { walker = true })
+	if walker {
+		return a.walk(entity)
+	}
+
+	m := a.members[entity]
+	<-m.ready
+	if m.spool == "" {
+		return nil
+	}
+	defer os.Remove(m.spool)
+
+	f, err := os.Open(m.spool)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	a.importMember(entity, m, f)
+	return nil
+}
+
+// walk reads the archive, importing the collection of the given entity and
+// spooling the collections of the other entities that are not imported yet.
+// Once it returns, all the members of the archive are ready.
+func (a *archive) walk(entity string) error {
+	walked := make(map[string]bool)
+	defer func() {
+		for e, m := range a.members {
+			if !walked[e] {
+				close(m.ready)
+			}
+		}
+	}()
+
+	if !*dryRun {
+		checksum, err := fileChecksum(a.path)
+		if err != nil {
+			return err
+		}
+		a.checksum = checksum
+	}
+
+	f, err := openDump(a.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		if aborted() {
+			return nil
+		}
+
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		e := memberEntity(hdr.Name)
+		m, ok := a.members[e]
+		if hdr.Typeflag != tar.TypeReg || !ok || walked[e] {
+			continue
+		}
+		m.name = a.path + ":" + hdr.Name
+		if err := a.readMember(entity, e, m, tr); err != nil {
+			return err
+		}
+		walked[e] = true
+		close(m.ready)
+	}
+}
+
+// readMember imports the collection m of entity e read from r, if e is the
+// entity of the import reading the archive, or spools it otherwise. Already
+// imported collections are skipped.
+func (a *archive) readMember(entity, e string, m *archiveMember, r io.Reader) error {
+	if !*dryRun {
+		cp, err := loadCheckpoint(e, a.date, a.checksum)
+		if err != nil {
+			return err
+		}
+		if cp.Completed {
+			fmt.Printf("[%s] skipped '%s': already imported\n", e, a.path)
+			report.startDump(e, a.path).skip()
+			return nil
+		}
+		m.cp = cp
+	}
+
+	if e == entity {
+		a.importMember(e, m, r)
+		return nil
+	}
+
+	if a.spool == "" {
+		dir, err := ioutil.TempDir(*spoolDir, "ght2dm-")
+		if err != nil {
+			return err
+		}
+		addSpool(dir)
+		a.spool = dir
+	}
+	f, err := os.Create(filepath.Join(a.spool, e+".bson"))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	m.spool = f.Name()
+	return nil
+}
+
+// importArchiveMember imports the BSON collection m of the given entity,
+// read from r. In dry-run mode, the collection is only read.
+func importArchiveMember(entity string, m *archiveMember, r io.Reader) {
+	if *dryRun {
+		fmt.Printf("[%s] checking '%s'\n", entity, m.name)
+		if err := importers[entity].dryRun(r, m.name, entity); err != nil {
+			fail(fmt.Sprintf("failed to read bson '%s': %v", m.name, err))
+		}
+		return
+	}
+
+	fmt.Printf("[%s] processing '%s'\n", entity, m.name)
+	rep := report.startDump(entity, m.name)
+	err := importerFor(entity).importDump(r, m.cp, rep)
+	rep.finish(err)
+	if err != nil {
+		fail(fmt.Sprintf("failed to import bson '%s': %v", m.name, err))
+		importFailed(err)
+	}
+}
+
+// spools are the directories where the collections of archives are spooled.
+var spools struct {
+	sync.Mutex
+	dirs []string
+}
+
+// addSpool records the spool directory dir, removed by removeSpools.
+func addSpool(dir string) {
+	spools.Lock()
+	spools.dirs = append(spools.dirs, dir)
+	spools.Unlock()
+}
+
+// removeSpools removes the spool directories, along with the collections
+// left by the imports that did not run.
+func removeSpools() {
+	spools.Lock()
+	defer spools.Unlock()
+
+	for _, dir := range spools.dirs {
+		if err := os.RemoveAll(dir); err != nil {
+			fail(err)
+		}
+	}
+	spools.dirs = nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2014 The DevMine Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeArchive writes a gzipped tar archive at path whose members are the
+// given files, directories being the names ending with a slash.
+func writeArchive(t *testing.T, path string, names ...string) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+	for _, name := range names {
+		hdr := &tar.Header{Name: name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(name))}
+		if name[len(name)-1] == '/' {
+			hdr.Typeflag, hdr.Mode, hdr.Size = tar.TypeDir, 0755, 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			if _, err := io.WriteString(tw, name); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// withSpoolDir runs f in dry-run mode, with a temporary spool directory, and
+// removes the spools it leaves.
+func withSpoolDir(t *testing.T, f func(dir string)) {
+	dir, err := ioutil.TempDir("", "ght2dm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(dry bool, spool string) { *dryRun, *spoolDir = dry, spool }(*dryRun, *spoolDir)
+	*dryRun, *spoolDir = true, dir
+
+	f(dir)
+	removeSpools()
+}
+
+func TestArchiveImportEntity(t *testing.T) {
+	withSpoolDir(t, func(dir string) {
+		path := filepath.Join(dir, "mongo-dump-2014-01-02.tar.gz")
+		writeArchive(t, path,
+			"dump/",
+			"dump/github/",
+			"dump/github/commits.bson",
+			"dump/github/users.bson",
+			"dump/github/users.metadata.json",
+			"dump/github/repos.bson",
+		)
+
+		a := newArchive(path, time.Date(2014, 1, 2, 0, 0, 0, 0, time.UTC))
+		var (
+			mu  sync.Mutex
+			got = make(map[string]string)
+		)
+		a.importMember = func(entity string, m *archiveMember, r io.Reader) {
+			bs, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Error(err)
+			}
+			mu.Lock()
+			got[entity] += string(bs)
+			mu.Unlock()
+		}
+
+		// The imports of all the entities are run concurrently, the first
+		// one reading the archive.
+		var wg sync.WaitGroup
+		for _, entity := range entities {
+			wg.Add(1)
+			go func(entity string) {
+				defer wg.Done()
+				if err := a.importEntity(entity); err != nil {
+					t.Errorf("%s: unexpected error: %v", entity, err)
+				}
+			}(entity)
+		}
+		wg.Wait()
+
+		want := map[string]string{
+			ghUsers:   "dump/github/users.bson",
+			ghRepos:   "dump/github/repos.bson",
+			ghCommits: "dump/github/commits.bson",
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got collections %v, want %v", got, want)
+		}
+
+		// Spooled collections are removed once imported.
+		if a.spool != "" {
+			fis, err := ioutil.ReadDir(a.spool)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(fis) != 0 {
+				t.Errorf("got %d collections left in the spool directory", len(fis))
+			}
+		}
+	})
+}
+
+func TestArchiveImportEntityCorrupted(t *testing.T) {
+	withSpoolDir(t, func(dir string) {
+		path := filepath.Join(dir, "mongo-dump-2014-01-02.tar.gz")
+		if err := ioutil.WriteFile(path, []byte("not a gzip file"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		a := newArchive(path, time.Date(2014, 1, 2, 0, 0, 0, 0, time.UTC))
+		a.importMember = func(entity string, m *archiveMember, r io.Reader) {
+			t.Errorf("unexpected import of %s", entity)
+		}
+
+		// Only the import reading the archive fails.
+		if err := a.importEntity(ghUsers); err == nil {
+			t.Error("reading a corrupted archive succeeded")
+		}
+		if err := a.importEntity(ghRepos); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestMemberEntity(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"dump/github/users.bson", ghUsers},
+		{"./dump/github/pull_requests.bson", ghPullRequests},
+		{"dump/github/users.metadata.json", ""},
+		{"dump/github/", ""},
+	}
+	for _, tt := range tests {
+		if got := memberEntity(tt.name); got != tt.want {
+			t.Errorf("memberEntity(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
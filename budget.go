@@ -0,0 +1,269 @@
+// Copyright 2014 The DevMine Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Exit codes of ght2dm
+const (
+	exitFatal        = 1 // invalid command line or configuration, database error
+	exitDumpFailed   = 2 // dumps, archives or staging tables failed to be imported
+	exitReadBudget   = 3 // too many documents could not be read or decoded
+	exitInsertBudget = 4 // too many documents could not be inserted
+)
+
+// errorBudget is the maximum number of failed documents allowed per dump or
+// per run, either as an absolute count or as a percentage of the documents
+// read.
+type errorBudget struct {
+	max     float64 // negative when unlimited
+	percent bool
+	all     bool // only exceeded when all the documents failed
+}
+
+// unlimitedBudget is the budget of entities without any budget.
+var unlimitedBudget = errorBudget{max: -1}
+
+// defaultDumpBudget is the error budget of the dumps of entities without any
+// budget given on the command line: a dump is failed when none of its
+// documents could be imported, which usually denotes a broken schema or an
+// unexpected dump format rather than a few bad documents.
+var defaultDumpBudget = errorBudget{all: true}
+
+func (b errorBudget) String() string {
+	switch {
+	case b.all:
+		return "all documents"
+	case b.percent:
+		return strconv.FormatFloat(b.max, 'f', -1, 64) + "%"
+	}
+	return strconv.FormatFloat(b.max, 'f', -1, 64)
+}
+
+// exceeded tells whether failed documents out of read documents exceed the
+// budget. Percentages are only checked when final is true, once all the
+// documents have been read, since the first failures of a dump would
+// otherwise exceed any percentage.
+func (b errorBudget) exceeded(failed, read int64, final bool) bool {
+	switch {
+	case b.all:
+		return final && read > 0 && failed >= read
+	case b.max < 0:
+		return false
+	case !b.percent:
+		return float64(failed) > b.max
+	case !final || read == 0:
+		return false
+	default:
+		return float64(failed)*100 > b.max*float64(read)
+	}
+}
+
+// errorBudgets are error budgets by GitHub entity. The budget of the empty
+// entity applies to the entities without any budget of their own.
+type errorBudgets map[string]errorBudget
+
+// Error budgets given on the command line, per dump and per run.
+var (
+	dumpBudgets = errorBudgets{}
+	runBudgets  = errorBudgets{}
+)
+
+// of returns the error budget of the given entity.
+func (bs errorBudgets) of(entity string) errorBudget {
+	if b, ok := bs[entity]; ok {
+		return b
+	}
+	if b, ok := bs[""]; ok {
+		return b
+	}
+	return unlimitedBudget
+}
+
+// parseErrorBudgets parses a comma separated list of error budgets, each of
+// them being a count (eg. 100) or a percentage (eg. 5%), optionally prefixed
+// by the entity it applies to (eg. users=100).
+func parseErrorBudgets(s string) (errorBudgets, error) {
+	bs := errorBudgets{}
+	if strings.TrimSpace(s) == "" {
+		return bs, nil
+	}
+
+	for _, spec := range strings.Split(s, ",") {
+		spec = strings.TrimSpace(spec)
+		orig := spec
+
+		var entity string
+		if i := strings.Index(spec, "="); i >= 0 {
+			entity, spec = spec[:i], spec[i+1:]
+			if _, ok := importers[entity]; !ok {
+				return nil, fmt.Errorf("invalid error budget: unsupported github entity %s", entity)
+			}
+		}
+		if _, ok := bs[entity]; ok {
+			return nil, fmt.Errorf("invalid error budget: duplicate budget for %s", budgetEntity(entity))
+		}
+
+		var b errorBudget
+		if strings.HasSuffix(spec, "%") {
+			b.percent = true
+			spec = strings.TrimSuffix(spec, "%")
+		}
+		max, err := strconv.ParseFloat(spec, 64)
+		if err != nil || max < 0 || (b.percent && max > 100) || (!b.percent && max != float64(int64(max))) {
+			return nil, fmt.Errorf("invalid error budget '%s': expected a count or a percentage", orig)
+		}
+		b.max = max
+		bs[entity] = b
+	}
+	return bs, nil
+}
+
+// budgetEntity returns a description of the entities of an error budget.
+func budgetEntity(entity string) string {
+	if entity == "" {
+		return "all entities"
+	}
+	return entity
+}
+
+// checkErrorBudgets parses the error budgets given on the command line. The
+// dumps of entities without any budget get defaultDumpBudget.
+func checkErrorBudgets() error {
+	var err error
+	if dumpBudgets, err = parseErrorBudgets(*maxDumpFailures); err != nil {
+		return err
+	}
+	if _, ok := dumpBudgets[""]; !ok {
+		dumpBudgets[""] = defaultDumpBudget
+	}
+	if runBudgets, err = parseErrorBudgets(*maxRunFailures); err != nil {
+		return err
+	}
+	return nil
+}
+
+// failureCounts holds the number of documents read and failed that are
+// checked against error budgets.
+type failureCounts struct {
+	read         int64
+	readFailed   int64 // documents that could not be read or decoded
+	insertFailed int64 // documents that could not be inserted
+}
+
+func (c failureCounts) failed() int64 {
+	return c.readFailed + c.insertFailed
+}
+
+// load returns a copy of c, which may be updated concurrently.
+func (c *failureCounts) load() failureCounts {
+	return failureCounts{
+		read:         atomic.LoadInt64(&c.read),
+		readFailed:   atomic.LoadInt64(&c.readFailed),
+		insertFailed: atomic.LoadInt64(&c.insertFailed),
+	}
+}
+
+// budgetError is returned by the import of a dump whose failed documents
+// exceed the error budget of the dump or of the run.
+type budgetError struct {
+	scope  string // dump or run
+	budget errorBudget
+	counts failureCounts
+}
+
+func (e *budgetError) Error() string {
+	if e.budget.all {
+		return fmt.Sprintf("all the %d documents of the %s failed (%d not read or decoded, %d not inserted)",
+			e.counts.read, e.scope, e.counts.readFailed, e.counts.insertFailed)
+	}
+	return fmt.Sprintf("error budget of the %s exceeded: %d of %d documents failed (%d not read or decoded, %d not inserted), more than %s",
+		e.scope, e.counts.failed(), e.counts.read, e.counts.readFailed, e.counts.insertFailed, e.budget)
+}
+
+// exitCode returns the exit code corresponding to the class of failures that
+// exceeded the budget, which is the class of most of the failed documents.
+func (e *budgetError) exitCode() int {
+	if e.counts.insertFailed > e.counts.readFailed {
+		return exitInsertBudget
+	}
+	return exitReadBudget
+}
+
+// checkBudgets checks the failed documents of the dump of rep, and those of
+// its entity within the run, against their error budgets. final tells whether
+// all the documents of the dump have been read.
+func checkBudgets(rep *dumpReport, final bool) error {
+	c := rep.counts.load()
+	if b := dumpBudgets.of(rep.entity); b.exceeded(c.failed(), c.read, final) {
+		return &budgetError{scope: "dump", budget: b, counts: c}
+	}
+	return checkRunBudget(rep.entity, rep.runCounts, final)
+}
+
+// checkRunBudget checks the failed documents of the given entity within the
+// run, whose counts are rc, against the error budget of the run.
+func checkRunBudget(entity string, rc *failureCounts, final bool) error {
+	c := rc.load()
+	if b := runBudgets.of(entity); b.exceeded(c.failed(), c.read, final) {
+		return &budgetError{scope: "run", budget: b, counts: c}
+	}
+	return nil
+}
+
+// errRunAborted is returned by the imports interrupted because the run has
+// been aborted.
+var errRunAborted = errors.New("run aborted")
+
+// exitStatus is the exit status of the run. Dumps may be imported
+// concurrently.
+var exitStatus struct {
+	sync.Mutex
+	code    int
+	aborted int32 // set atomically, checked for every document
+}
+
+// importFailed records that the import of a dump, an archive or a staging
+// table failed because of err, so that ght2dm exits with a non-zero status.
+// Exceeding an error budget aborts the run: the imports in progress are
+// rolled back and the imports not started yet are skipped.
+func importFailed(err error) {
+	code := exitDumpFailed
+	berr, ok := err.(*budgetError)
+	if ok {
+		code = berr.exitCode()
+	}
+
+	exitStatus.Lock()
+	defer exitStatus.Unlock()
+
+	// The most specific code wins.
+	if code > exitStatus.code {
+		exitStatus.code = code
+	}
+	if ok {
+		atomic.StoreInt32(&exitStatus.aborted, 1)
+	}
+}
+
+// aborted tells whether the run has been aborted.
+func aborted() bool {
+	return atomic.LoadInt32(&exitStatus.aborted) != 0
+}
+
+// exitCode returns the exit code of the run.
+func exitCode() int {
+	exitStatus.Lock()
+	defer exitStatus.Unlock()
+
+	return exitStatus.code
+}
@@ -0,0 +1,178 @@
+// Copyright 2014 The DevMine Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseErrorBudgets(t *testing.T) {
+	tests := []struct {
+		spec string
+		want errorBudgets
+	}{
+		{"", errorBudgets{}},
+		{"  ", errorBudgets{}},
+		{"100", errorBudgets{"": {max: 100}}},
+		{"0", errorBudgets{"": {max: 0}}},
+		{"5%", errorBudgets{"": {max: 5, percent: true}}},
+		{"0.5%", errorBudgets{"": {max: 0.5, percent: true}}},
+		{"users=100, 1%", errorBudgets{
+			ghUsers: {max: 100},
+			"":      {max: 1, percent: true},
+		}},
+		{"users=10%,commits=0", errorBudgets{
+			ghUsers:   {max: 10, percent: true},
+			ghCommits: {max: 0},
+		}},
+	}
+	for _, tt := range tests {
+		got, err := parseErrorBudgets(tt.spec)
+		if err != nil {
+			t.Errorf("parseErrorBudgets(%q): unexpected error: %v", tt.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseErrorBudgets(%q) = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrorBudgetsInvalid(t *testing.T) {
+	specs := []string{
+		"foo",
+		"-1",
+		"1.5",
+		"101%",
+		"%",
+		"users=",
+		"nope=10",
+		"10,20",
+		"users=10,users=20",
+		"10,",
+	}
+	for _, spec := range specs {
+		if bs, err := parseErrorBudgets(spec); err == nil {
+			t.Errorf("parseErrorBudgets(%q) = %v, want an error", spec, bs)
+		}
+	}
+}
+
+func TestErrorBudgetsOf(t *testing.T) {
+	bs := errorBudgets{ghUsers: {max: 10}, "": {max: 1}}
+	if got := bs.of(ghUsers); got != (errorBudget{max: 10}) {
+		t.Errorf("budget of users = %v, want 10", got)
+	}
+	if got := bs.of(ghRepos); got != (errorBudget{max: 1}) {
+		t.Errorf("budget of repos = %v, want 1", got)
+	}
+	if got := (errorBudgets{}).of(ghRepos); got != unlimitedBudget {
+		t.Errorf("budget of repos without any budget = %v, want unlimited", got)
+	}
+}
+
+func TestErrorBudgetExceeded(t *testing.T) {
+	tests := []struct {
+		budget       errorBudget
+		failed, read int64
+		final        bool
+		want         bool
+	}{
+		{unlimitedBudget, 1000, 1000, true, false},
+		{errorBudget{max: 0}, 0, 10, false, false},
+		{errorBudget{max: 0}, 1, 10, false, true},
+		{errorBudget{max: 10}, 10, 10, false, false},
+		{errorBudget{max: 10}, 11, 100, false, true},
+		{errorBudget{max: 10}, 11, 100, true, true},
+
+		// Percentages are only checked once the dump has been read.
+		{errorBudget{max: 5, percent: true}, 10, 10, false, false},
+		{errorBudget{max: 5, percent: true}, 5, 100, true, false},
+		{errorBudget{max: 5, percent: true}, 6, 100, true, true},
+		{errorBudget{max: 0, percent: true}, 1, 1000, true, true},
+		{errorBudget{max: 0, percent: true}, 0, 0, true, false},
+		{errorBudget{max: 100, percent: true}, 10, 10, true, false},
+
+		// The default budget is only exceeded when all the documents failed.
+		{defaultDumpBudget, 10, 10, false, false},
+		{defaultDumpBudget, 9, 10, true, false},
+		{defaultDumpBudget, 10, 10, true, true},
+		{defaultDumpBudget, 0, 0, true, false},
+	}
+	for _, tt := range tests {
+		if got := tt.budget.exceeded(tt.failed, tt.read, tt.final); got != tt.want {
+			t.Errorf("budget %v: exceeded(%d, %d, %t) = %t, want %t",
+				tt.budget, tt.failed, tt.read, tt.final, got, tt.want)
+		}
+	}
+}
+
+func TestBudgetErrorExitCode(t *testing.T) {
+	tests := []struct {
+		counts failureCounts
+		want   int
+	}{
+		{failureCounts{read: 10, readFailed: 3, insertFailed: 1}, exitReadBudget},
+		{failureCounts{read: 10, readFailed: 1, insertFailed: 3}, exitInsertBudget},
+		{failureCounts{read: 10, readFailed: 2, insertFailed: 2}, exitReadBudget},
+	}
+	for _, tt := range tests {
+		err := &budgetError{scope: "dump", budget: errorBudget{max: 1}, counts: tt.counts}
+		if got := err.exitCode(); got != tt.want {
+			t.Errorf("exit code of %v = %d, want %d", err, got, tt.want)
+		}
+	}
+}
+
+func TestDefaultErrorBudgets(t *testing.T) {
+	defer func(dump, run string) {
+		*maxDumpFailures, *maxRunFailures = dump, run
+		dumpBudgets, runBudgets = errorBudgets{}, errorBudgets{}
+	}(*maxDumpFailures, *maxRunFailures)
+
+	*maxDumpFailures, *maxRunFailures = "", ""
+	if err := checkErrorBudgets(); err != nil {
+		t.Fatal(err)
+	}
+
+	insertErr := errors.New("impossible to insert github user")
+	rr := &runReport{Entities: make(map[string]*entityReport)}
+	partial := rr.startDump(ghUsers, "2014-01-01.bson")
+	failed := rr.startDump(ghUsers, "2014-01-02.bson")
+	for i := 0; i < 10; i++ {
+		partial.read()
+		failed.read()
+		failed.failed(insertErr, true)
+		if i%2 == 0 {
+			partial.failed(insertErr, true)
+		}
+	}
+
+	if err := checkBudgets(partial, true); err != nil {
+		t.Errorf("dump with 5 of 10 documents failed: unexpected error: %v", err)
+	}
+	if err := checkBudgets(failed, false); err != nil {
+		t.Errorf("dump not read yet: unexpected error: %v", err)
+	}
+	err := checkBudgets(failed, true)
+	berr, ok := err.(*budgetError)
+	if !ok {
+		t.Fatalf("dump with all documents failed: got error %v, want a budget error", err)
+	}
+	if berr.exitCode() != exitInsertBudget {
+		t.Errorf("got exit code %d, want %d", berr.exitCode(), exitInsertBudget)
+	}
+
+	// An explicit budget replaces the default one.
+	*maxDumpFailures = "100%"
+	if err := checkErrorBudgets(); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkBudgets(failed, true); err != nil {
+		t.Errorf("budget of 100%%: unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,845 @@
+// Copyright 2014 The DevMine Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// bulkImporters maps GitHub entities to the importers used instead of the
+// default ones when bulk imports are enabled.
+//
+// Bulk importers copy the documents of a dump into temporary staging tables,
+// using COPY, and merge them into the DevMine tables using set-based queries,
+// the same way insert_repos() merges repositories. The staging tables are
+// created by each writer and dropped when its transaction is committed.
+// Documents that refer to entities missing from the database are not merged,
+// counted as failed and written to the dead-letter file: the staging tables
+// hold the origin of their rows (see origin) for this purpose.
+var bulkImporters = map[string]*importer{
+	ghUsers:             bulkUsersImporter,
+	ghOrgMembers:        bulkOrgMembersImporter,
+	ghFollowers:         bulkFollowersImporter,
+	ghRepoCollaborators: bulkRepoCollaboImporter,
+	ghWatchers:          bulkWatchersImporter,
+	ghIssues:            bulkIssuesImporter,
+	ghIssueComments:     bulkIssueCommentsImporter,
+	ghIssueEvents:       bulkIssueEventsImporter,
+	ghPullRequests:      bulkPullRequestsImporter,
+	ghPullReqComments:   bulkPullRequestCommentsImporter,
+}
+
+// Staging tables fields. The last ones of the tables having an unresolved
+// query hold the origin of the rows.
+var (
+	tmpUsersFields = []string{
+		"github_id",
+		"type",
+		"login",
+		"name",
+		"bio",
+		"company",
+		"email",
+		"hireable",
+		"location",
+		"avatar_url",
+		"html_url",
+		"followers_count",
+		"following_count",
+		"created_at",
+		"updated_at",
+	}
+	tmpOrgMembersFields    = []string{"login", "org", "dump_name", "dump_offset", "document"}
+	tmpFollowersFields     = []string{"login", "follows", "dump_name", "dump_offset", "document"}
+	tmpReposCollabosFields = []string{"login", "repository_full_name", "dump_name", "dump_offset", "document"}
+	tmpWatchersFields      = []string{"login", "repository_full_name", "dump_name", "dump_offset", "document"}
+	tmpIssuesFields        = []string{
+		"github_id",
+		"repository_full_name",
+		"number",
+		"login",
+		"assignee_login",
+		"title",
+		"body",
+		"state",
+		"comments_count",
+		"created_at",
+		"updated_at",
+		"closed_at",
+		"dump_name",
+		"dump_offset",
+		"document",
+	}
+	tmpIssueCommentsFields = []string{
+		"github_id",
+		"repository_full_name",
+		"issue_number",
+		"login",
+		"body",
+		"created_at",
+		"updated_at",
+		"dump_name",
+		"dump_offset",
+		"document",
+	}
+	tmpIssueEventsFields = []string{
+		"github_id",
+		"repository_full_name",
+		"issue_number",
+		"login",
+		"event",
+		"commit_id",
+		"created_at",
+		"dump_name",
+		"dump_offset",
+		"document",
+	}
+	tmpPullRequestsFields = []string{
+		"github_id",
+		"repository_full_name",
+		"head_repository_full_name",
+		"number",
+		"login",
+		"title",
+		"body",
+		"state",
+		"merged",
+		"merged_at",
+		"head_ref",
+		"head_sha",
+		"base_ref",
+		"base_sha",
+		"created_at",
+		"updated_at",
+		"closed_at",
+		"dump_name",
+		"dump_offset",
+		"document",
+	}
+	tmpPullRequestCommentsFields = []string{
+		"github_id",
+		"repository_full_name",
+		"pull_request_number",
+		"login",
+		"body",
+		"path",
+		"position",
+		"commit_id",
+		"created_at",
+		"updated_at",
+		"dump_name",
+		"dump_offset",
+		"document",
+	}
+)
+
+// bulkUsersImporter is the bulk importer of GitHub users and organizations.
+var bulkUsersImporter = &importer{
+	constrained: usersImporter.constrained,
+	setup: []string{`
+		CREATE TEMP TABLE tmp_gh_users (
+			github_id bigint NOT NULL,
+			type character varying NOT NULL,
+			login character varying NOT NULL,
+			name character varying,
+			bio character varying,
+			company character varying,
+			email character varying,
+			hireable boolean,
+			location character varying,
+			avatar_url character varying,
+			html_url character varying,
+			followers_count integer,
+			following_count integer,
+			created_at timestamp with time zone,
+			updated_at timestamp with time zone
+		) ON COMMIT DROP`,
+	},
+	queries: []string{pq.CopyIn("tmp_gh_users", tmpUsersFields...)},
+	copyIn:  true,
+	decode:  usersImporter.decode,
+	key:     usersImporter.key,
+	insert: func(txn *sql.Tx, stmts []*sql.Stmt, doc interface{}, o origin) error {
+		ghu := doc.(ghUser)
+		printVerbose("importing tmp gh_user with login", ghu.Login)
+
+		if _, err := validateGhUser(ghu); err != nil {
+			return err
+		}
+
+		// Some documents only have a creation date, so for these ones, we set
+		// the last modification date to the creation date.
+		if ghu.UpdatedAt == "" {
+			ghu.UpdatedAt = ghu.CreatedAt
+		}
+
+		_, err := stmts[0].Exec(
+			ghu.ID,
+			ghu.Type,
+			removeNullByte(ghu.Login),
+			removeNullByte(ghu.Name),
+			removeNullByte(ghu.Bio),
+			removeNullByte(ghu.Company),
+			removeNullByte(ghu.Email),
+			ghu.Hireable,
+			removeNullByte(ghu.Location),
+			removeNullByte(ghu.AvatarURL),
+			removeNullByte(ghu.HTMLURL),
+			ghu.Followers,
+			ghu.Following,
+			nullIfEmpty(ghu.CreatedAt),
+			nullIfEmpty(ghu.UpdatedAt))
+		if err != nil {
+			fail(err)
+			return errors.New("impossible to insert tmp github user with login " + ghu.Login)
+		}
+		return nil
+	},
+	refresh: []string{
+		// Users are refreshed along with their GitHub user.
+		`WITH tgu AS (
+			SELECT DISTINCT ON (github_id) *
+			FROM tmp_gh_users
+			WHERE type = 'User' AND updated_at IS NOT NULL
+			ORDER BY github_id, updated_at DESC
+		), refreshed AS (
+			UPDATE gh_users AS gu
+			SET
+				login = tgu.login,
+				bio = tgu.bio,
+				company = tgu.company,
+				email = tgu.email,
+				hireable = tgu.hireable,
+				location = tgu.location,
+				avatar_url = tgu.avatar_url,
+				html_url = tgu.html_url,
+				followers_count = tgu.followers_count,
+				following_count = tgu.following_count,
+				created_at = tgu.created_at,
+				updated_at = tgu.updated_at
+			FROM tgu
+			WHERE gu.github_id = tgu.github_id AND (gu.updated_at IS NULL OR gu.updated_at < tgu.updated_at)
+			RETURNING gu.user_id, tgu.login, tgu.name, tgu.email
+		)
+		UPDATE users AS u
+		SET username = r.login, name = r.name, email = r.email
+		FROM refreshed AS r
+		WHERE u.id = r.user_id`,
+		`UPDATE gh_organizations AS go
+		SET
+			login = tgu.login,
+			avatar_url = tgu.avatar_url,
+			html_url = tgu.html_url,
+			name = tgu.name,
+			company = tgu.company,
+			location = tgu.location,
+			email = tgu.email,
+			created_at = tgu.created_at,
+			updated_at = tgu.updated_at
+		FROM (
+			SELECT DISTINCT ON (github_id) *
+			FROM tmp_gh_users
+			WHERE type = 'Organization' AND updated_at IS NOT NULL
+			ORDER BY github_id, updated_at DESC
+		) AS tgu
+		WHERE go.github_id = tgu.github_id AND (go.updated_at IS NULL OR go.updated_at < tgu.updated_at)`,
+	},
+	merge: []string{
+		// The ids of the new users are allocated beforehand so that each
+		// GitHub user can reference its user.
+		`CREATE TEMP TABLE tmp_new_gh_users ON COMMIT DROP AS
+		SELECT nextval(pg_get_serial_sequence('users', 'id')) AS user_id, tgu.*
+		FROM (
+			SELECT DISTINCT ON (tgu.github_id) tgu.*
+			FROM tmp_gh_users AS tgu
+			LEFT JOIN gh_users AS gu ON gu.github_id = tgu.github_id
+			WHERE tgu.type = 'User' AND gu.id IS NULL
+			ORDER BY tgu.github_id, tgu.updated_at DESC NULLS LAST
+		) AS tgu`,
+		`INSERT INTO users (id, username, name, email)
+		SELECT user_id, login, name, email
+		FROM tmp_new_gh_users`,
+		`INSERT INTO gh_users (user_id, github_id, login, bio, company, email, hireable, location, avatar_url, html_url, followers_count, following_count, created_at, updated_at)
+		SELECT user_id, github_id, login, bio, company, email, hireable, location, avatar_url, html_url, followers_count, following_count, created_at, updated_at
+		FROM tmp_new_gh_users`,
+		`INSERT INTO gh_organizations (login, github_id, avatar_url, html_url, name, company, location, email, created_at, updated_at)
+		SELECT DISTINCT ON (tgu.github_id)
+			tgu.login,
+			tgu.github_id,
+			tgu.avatar_url,
+			tgu.html_url,
+			tgu.name,
+			tgu.company,
+			tgu.location,
+			tgu.email,
+			tgu.created_at,
+			tgu.updated_at
+		FROM tmp_gh_users AS tgu
+		LEFT JOIN gh_organizations AS go ON go.github_id = tgu.github_id
+		WHERE tgu.type = 'Organization' AND go.id IS NULL
+		ORDER BY tgu.github_id, tgu.updated_at DESC NULLS LAST`,
+	},
+	// New users are counted as the GitHub users referencing them.
+	uncounted: 2,
+}
+
+// bulkOrgMembersImporter is the bulk importer of GitHub organization members.
+var bulkOrgMembersImporter = &importer{
+	constrained: orgMembersImporter.constrained,
+	setup: []string{`
+		CREATE TEMP TABLE tmp_gh_org_members (
+			login character varying NOT NULL,
+			org character varying NOT NULL,
+			dump_name character varying,
+			dump_offset bigint,
+			document bytea
+		) ON COMMIT DROP`,
+	},
+	queries: []string{pq.CopyIn("tmp_gh_org_members", tmpOrgMembersFields...)},
+	copyIn:  true,
+	decode:  orgMembersImporter.decode,
+	key:     orgMembersImporter.key,
+	insert: func(txn *sql.Tx, stmts []*sql.Stmt, doc interface{}, o origin) error {
+		ghom := doc.(ghOrgMember)
+		if _, err := stmts[0].Exec(removeNullByte(ghom.Login), removeNullByte(ghom.Org), o.dump, o.offset, o.document()); err != nil {
+			fail(err)
+			return fmt.Errorf("impossible to insert tmp member organization with id %d", ghom.ID)
+		}
+		return nil
+	},
+	merge: []string{`
+		INSERT INTO gh_users_organizations (gh_user_id, gh_organization_id)
+		SELECT DISTINCT gu.id, go.id
+		FROM tmp_gh_org_members AS tgom
+		INNER JOIN gh_users AS gu ON gu.login = tgom.login
+		INNER JOIN gh_organizations AS go ON go.login = tgom.org
+		LEFT JOIN gh_users_organizations AS guo ON (guo.gh_user_id = gu.id AND guo.gh_organization_id = go.id)
+		WHERE guo.gh_user_id IS NULL`,
+	},
+	unresolved: `
+		SELECT tgom.dump_name, tgom.dump_offset, tgom.document
+		FROM tmp_gh_org_members AS tgom
+		WHERE NOT EXISTS (SELECT 1 FROM gh_users AS gu WHERE gu.login = tgom.login)
+			OR NOT EXISTS (SELECT 1 FROM gh_organizations AS go WHERE go.login = tgom.org)`,
+}
+
+// bulkFollowersImporter is the bulk importer of GitHub followers.
+var bulkFollowersImporter = &importer{
+	constrained: followersImporter.constrained,
+	setup: []string{`
+		CREATE TEMP TABLE tmp_gh_followers (
+			login character varying NOT NULL,
+			follows character varying NOT NULL,
+			dump_name character varying,
+			dump_offset bigint,
+			document bytea
+		) ON COMMIT DROP`,
+	},
+	queries: []string{pq.CopyIn("tmp_gh_followers", tmpFollowersFields...)},
+	copyIn:  true,
+	decode:  followersImporter.decode,
+	key:     followersImporter.key,
+	insert: func(txn *sql.Tx, stmts []*sql.Stmt, doc interface{}, o origin) error {
+		ghf := doc.(ghFollower)
+		if _, err := stmts[0].Exec(removeNullByte(ghf.Login), removeNullByte(ghf.Follows), o.dump, o.offset, o.document()); err != nil {
+			fail(err)
+			return fmt.Errorf("impossible to insert tmp follower %s of %s", ghf.Login, ghf.Follows)
+		}
+		return nil
+	},
+	merge: []string{`
+		INSERT INTO gh_followers (gh_user_id, gh_follower_id)
+		SELECT DISTINCT gu.id, fgu.id
+		FROM tmp_gh_followers AS tgf
+		INNER JOIN gh_users AS gu ON gu.login = tgf.follows
+		INNER JOIN gh_users AS fgu ON fgu.login = tgf.login
+		LEFT JOIN gh_followers AS gf ON (gf.gh_user_id = gu.id AND gf.gh_follower_id = fgu.id)
+		WHERE gf.gh_user_id IS NULL`,
+	},
+	unresolved: `
+		SELECT tgf.dump_name, tgf.dump_offset, tgf.document
+		FROM tmp_gh_followers AS tgf
+		WHERE NOT EXISTS (SELECT 1 FROM gh_users AS gu WHERE gu.login = tgf.follows)
+			OR NOT EXISTS (SELECT 1 FROM gh_users AS fgu WHERE fgu.login = tgf.login)`,
+}
+
+// bulkRepoCollaboImporter is the bulk importer of GitHub repository
+// collaborators.
+var bulkRepoCollaboImporter = &importer{
+	constrained: repoCollaboImporter.constrained,
+	setup: []string{`
+		CREATE TEMP TABLE tmp_gh_repo_collaborators (
+			login character varying NOT NULL,
+			repository_full_name character varying NOT NULL,
+			dump_name character varying,
+			dump_offset bigint,
+			document bytea
+		) ON COMMIT DROP`,
+	},
+	queries: []string{pq.CopyIn("tmp_gh_repo_collaborators", tmpReposCollabosFields...)},
+	copyIn:  true,
+	decode:  repoCollaboImporter.decode,
+	key:     repoCollaboImporter.key,
+	insert: func(txn *sql.Tx, stmts []*sql.Stmt, doc interface{}, o origin) error {
+		ghrc := doc.(ghRepoCollaborator)
+		if _, err := stmts[0].Exec(removeNullByte(ghrc.Login), removeNullByte(ghrc.Owner+"/"+ghrc.Repo), o.dump, o.offset, o.document()); err != nil {
+			fail(err)
+			return fmt.Errorf("impossible to insert tmp repository collaborator with id %d", ghrc.ID)
+		}
+		return nil
+	},
+	merge: []string{`
+		INSERT INTO users_repositories (user_id, repository_id)
+		SELECT DISTINCT gu.user_id, gr.repository_id
+		FROM tmp_gh_repo_collaborators AS tgrc
+		INNER JOIN gh_users AS gu ON gu.login = tgrc.login
+		INNER JOIN gh_repositories AS gr ON gr.full_name = tgrc.repository_full_name
+		LEFT JOIN users_repositories AS ur ON (ur.user_id = gu.user_id AND ur.repository_id = gr.repository_id)
+		WHERE ur.user_id IS NULL`,
+	},
+	unresolved: `
+		SELECT tgrc.dump_name, tgrc.dump_offset, tgrc.document
+		FROM tmp_gh_repo_collaborators AS tgrc
+		WHERE NOT EXISTS (SELECT 1 FROM gh_users AS gu WHERE gu.login = tgrc.login)
+			OR NOT EXISTS (SELECT 1 FROM gh_repositories AS gr WHERE gr.full_name = tgrc.repository_full_name)`,
+}
+
+// bulkWatchersImporter is the bulk importer of GitHub watchers (stargazers).
+var bulkWatchersImporter = &importer{
+	constrained: watchersImporter.constrained,
+	setup: []string{`
+		CREATE TEMP TABLE tmp_gh_watchers (
+			login character varying NOT NULL,
+			repository_full_name character varying NOT NULL,
+			dump_name character varying,
+			dump_offset bigint,
+			document bytea
+		) ON COMMIT DROP`,
+	},
+	queries: []string{pq.CopyIn("tmp_gh_watchers", tmpWatchersFields...)},
+	copyIn:  true,
+	decode:  watchersImporter.decode,
+	key:     watchersImporter.key,
+	insert: func(txn *sql.Tx, stmts []*sql.Stmt, doc interface{}, o origin) error {
+		ghw := doc.(ghWatcher)
+		if _, err := stmts[0].Exec(removeNullByte(ghw.Login), removeNullByte(ghw.Owner+"/"+ghw.Repo), o.dump, o.offset, o.document()); err != nil {
+			fail(err)
+			return fmt.Errorf("impossible to insert tmp watcher %s of %s/%s", ghw.Login, ghw.Owner, ghw.Repo)
+		}
+		return nil
+	},
+	merge: []string{`
+		INSERT INTO gh_stargazers (gh_user_id, repository_id)
+		SELECT DISTINCT gu.id, gr.repository_id
+		FROM tmp_gh_watchers AS tgw
+		INNER JOIN gh_users AS gu ON gu.login = tgw.login
+		INNER JOIN gh_repositories AS gr ON gr.full_name = tgw.repository_full_name
+		LEFT JOIN gh_stargazers AS gs ON (gs.gh_user_id = gu.id AND gs.repository_id = gr.repository_id)
+		WHERE gs.gh_user_id IS NULL`,
+	},
+	unresolved: `
+		SELECT tgw.dump_name, tgw.dump_offset, tgw.document
+		FROM tmp_gh_watchers AS tgw
+		WHERE NOT EXISTS (SELECT 1 FROM gh_users AS gu WHERE gu.login = tgw.login)
+			OR NOT EXISTS (SELECT 1 FROM gh_repositories AS gr WHERE gr.full_name = tgw.repository_full_name)`,
+}
+
+// bulkIssuesImporter is the bulk importer of GitHub issues.
+var bulkIssuesImporter = &importer{
+	constrained: issuesImporter.constrained,
+	setup: []string{`
+		CREATE TEMP TABLE tmp_gh_issues (
+			github_id bigint NOT NULL,
+			repository_full_name character varying NOT NULL,
+			number integer NOT NULL,
+			login character varying,
+			assignee_login character varying,
+			title character varying,
+			body text,
+			state character varying,
+			comments_count integer,
+			created_at timestamp with time zone,
+			updated_at timestamp with time zone,
+			closed_at timestamp with time zone,
+			dump_name character varying,
+			dump_offset bigint,
+			document bytea
+		) ON COMMIT DROP`,
+	},
+	queries: []string{pq.CopyIn("tmp_gh_issues", tmpIssuesFields...)},
+	copyIn:  true,
+	decode:  issuesImporter.decode,
+	key:     issuesImporter.key,
+	insert: func(txn *sql.Tx, stmts []*sql.Stmt, doc interface{}, o origin) error {
+		ghi := doc.(ghIssue)
+		_, err := stmts[0].Exec(
+			ghi.ID,
+			removeNullByte(ghi.Owner+"/"+ghi.Repo),
+			ghi.Number,
+			removeNullByte(ghi.User.Login),
+			nullIfEmpty(ghi.Assignee.Login),
+			removeNullByte(ghi.Title),
+			removeNullByte(ghi.Body),
+			ghi.State,
+			ghi.Comments,
+			nullIfEmpty(ghi.CreatedAt),
+			nullIfEmpty(ghi.UpdatedAt),
+			nullIfEmpty(ghi.ClosedAt),
+			o.dump,
+			o.offset,
+			o.document())
+		if err != nil {
+			fail(err)
+			return fmt.Errorf("impossible to insert tmp issue with github_id %d", ghi.ID)
+		}
+		return nil
+	},
+	merge: []string{`
+		INSERT INTO gh_issues (repository_id, gh_user_id, assignee_id, github_id, number, title, body, state, comments_count, created_at, updated_at, closed_at)
+		SELECT DISTINCT ON (tgi.github_id)
+			gr.repository_id,
+			gu.id,
+			agu.id,
+			tgi.github_id,
+			tgi.number,
+			tgi.title,
+			tgi.body,
+			tgi.state,
+			tgi.comments_count,
+			tgi.created_at,
+			tgi.updated_at,
+			tgi.closed_at
+		FROM tmp_gh_issues AS tgi
+		INNER JOIN gh_repositories AS gr ON gr.full_name = tgi.repository_full_name
+		INNER JOIN gh_users AS gu ON gu.login = tgi.login
+		LEFT JOIN gh_users AS agu ON agu.login = tgi.assignee_login
+		LEFT JOIN gh_issues AS gi ON gi.github_id = tgi.github_id
+		WHERE gi.id IS NULL
+		ORDER BY tgi.github_id, tgi.updated_at DESC NULLS LAST`,
+	},
+	unresolved: `
+		SELECT tgi.dump_name, tgi.dump_offset, tgi.document
+		FROM tmp_gh_issues AS tgi
+		WHERE NOT EXISTS (SELECT 1 FROM gh_repositories AS gr WHERE gr.full_name = tgi.repository_full_name)
+			OR NOT EXISTS (SELECT 1 FROM gh_users AS gu WHERE gu.login = tgi.login)`,
+}
+
+// bulkIssueCommentsImporter is the bulk importer of comments on GitHub issues.
+var bulkIssueCommentsImporter = &importer{
+	constrained: issueCommentsImporter.constrained,
+	setup: []string{`
+		CREATE TEMP TABLE tmp_gh_issue_comments (
+			github_id bigint NOT NULL,
+			repository_full_name character varying NOT NULL,
+			issue_number integer NOT NULL,
+			login character varying,
+			body text,
+			created_at timestamp with time zone,
+			updated_at timestamp with time zone,
+			dump_name character varying,
+			dump_offset bigint,
+			document bytea
+		) ON COMMIT DROP`,
+	},
+	queries: []string{pq.CopyIn("tmp_gh_issue_comments", tmpIssueCommentsFields...)},
+	copyIn:  true,
+	decode:  issueCommentsImporter.decode,
+	key:     issueCommentsImporter.key,
+	insert: func(txn *sql.Tx, stmts []*sql.Stmt, doc interface{}, o origin) error {
+		ghic := doc.(ghIssueComment)
+		_, err := stmts[0].Exec(
+			ghic.ID,
+			removeNullByte(ghic.Owner+"/"+ghic.Repo),
+			ghic.IssueID,
+			removeNullByte(ghic.User.Login),
+			removeNullByte(ghic.Body),
+			nullIfEmpty(ghic.CreatedAt),
+			nullIfEmpty(ghic.UpdatedAt),
+			o.dump,
+			o.offset,
+			o.document())
+		if err != nil {
+			fail(err)
+			return fmt.Errorf("impossible to insert tmp issue comment with github_id %d", ghic.ID)
+		}
+		return nil
+	},
+	merge: []string{`
+		INSERT INTO gh_issue_comments (gh_issue_id, gh_user_id, github_id, body, created_at, updated_at)
+		SELECT DISTINCT ON (tgic.github_id)
+			gi.id,
+			gu.id,
+			tgic.github_id,
+			tgic.body,
+			tgic.created_at,
+			tgic.updated_at
+		FROM tmp_gh_issue_comments AS tgic
+		INNER JOIN gh_repositories AS gr ON gr.full_name = tgic.repository_full_name
+		INNER JOIN gh_issues AS gi ON (gi.repository_id = gr.repository_id AND gi.number = tgic.issue_number)
+		INNER JOIN gh_users AS gu ON gu.login = tgic.login
+		LEFT JOIN gh_issue_comments AS gic ON gic.github_id = tgic.github_id
+		WHERE gic.id IS NULL
+		ORDER BY tgic.github_id, tgic.updated_at DESC NULLS LAST`,
+	},
+	unresolved: `
+		SELECT tgic.dump_name, tgic.dump_offset, tgic.document
+		FROM tmp_gh_issue_comments AS tgic
+		WHERE NOT EXISTS (
+				SELECT 1
+				FROM gh_issues AS gi
+				INNER JOIN gh_repositories AS gr ON gr.repository_id = gi.repository_id
+				WHERE gr.full_name = tgic.repository_full_name AND gi.number = tgic.issue_number)
+			OR NOT EXISTS (SELECT 1 FROM gh_users AS gu WHERE gu.login = tgic.login)`,
+}
+
+// bulkIssueEventsImporter is the bulk importer of events of GitHub issues.
+var bulkIssueEventsImporter = &importer{
+	constrained: issueEventsImporter.constrained,
+	setup: []string{`
+		CREATE TEMP TABLE tmp_gh_issue_events (
+			github_id bigint NOT NULL,
+			repository_full_name character varying NOT NULL,
+			issue_number integer NOT NULL,
+			login character varying,
+			event character varying NOT NULL,
+			commit_id character varying,
+			created_at timestamp with time zone,
+			dump_name character varying,
+			dump_offset bigint,
+			document bytea
+		) ON COMMIT DROP`,
+	},
+	queries: []string{pq.CopyIn("tmp_gh_issue_events", tmpIssueEventsFields...)},
+	copyIn:  true,
+	decode:  issueEventsImporter.decode,
+	key:     issueEventsImporter.key,
+	insert: func(txn *sql.Tx, stmts []*sql.Stmt, doc interface{}, o origin) error {
+		ghie := doc.(ghIssueEvent)
+		_, err := stmts[0].Exec(
+			ghie.ID,
+			removeNullByte(ghie.Owner+"/"+ghie.Repo),
+			ghie.IssueID,
+			nullIfEmpty(ghie.Actor.Login),
+			ghie.Event,
+			nullIfEmpty(ghie.CommitID),
+			nullIfEmpty(ghie.CreatedAt),
+			o.dump,
+			o.offset,
+			o.document())
+		if err != nil {
+			fail(err)
+			return fmt.Errorf("impossible to insert tmp issue event with github_id %d", ghie.ID)
+		}
+		return nil
+	},
+	merge: []string{`
+		INSERT INTO gh_issue_events (gh_issue_id, gh_user_id, github_id, event, commit_id, created_at)
+		SELECT DISTINCT ON (tgie.github_id)
+			gi.id,
+			gu.id,
+			tgie.github_id,
+			tgie.event,
+			tgie.commit_id,
+			tgie.created_at
+		FROM tmp_gh_issue_events AS tgie
+		INNER JOIN gh_repositories AS gr ON gr.full_name = tgie.repository_full_name
+		INNER JOIN gh_issues AS gi ON (gi.repository_id = gr.repository_id AND gi.number = tgie.issue_number)
+		LEFT JOIN gh_users AS gu ON gu.login = tgie.login
+		LEFT JOIN gh_issue_events AS gie ON gie.github_id = tgie.github_id
+		WHERE gie.id IS NULL
+		ORDER BY tgie.github_id`,
+	},
+	unresolved: `
+		SELECT tgie.dump_name, tgie.dump_offset, tgie.document
+		FROM tmp_gh_issue_events AS tgie
+		WHERE NOT EXISTS (
+			SELECT 1
+			FROM gh_issues AS gi
+			INNER JOIN gh_repositories AS gr ON gr.repository_id = gi.repository_id
+			WHERE gr.full_name = tgie.repository_full_name AND gi.number = tgie.issue_number)`,
+}
+
+// bulkPullRequestsImporter is the bulk importer of GitHub pull requests.
+var bulkPullRequestsImporter = &importer{
+	constrained: pullRequestsImporter.constrained,
+	setup: []string{`
+		CREATE TEMP TABLE tmp_gh_pull_requests (
+			github_id bigint NOT NULL,
+			repository_full_name character varying NOT NULL,
+			head_repository_full_name character varying,
+			number integer NOT NULL,
+			login character varying,
+			title character varying,
+			body text,
+			state character varying,
+			merged boolean,
+			merged_at timestamp with time zone,
+			head_ref character varying,
+			head_sha character varying,
+			base_ref character varying,
+			base_sha character varying,
+			created_at timestamp with time zone,
+			updated_at timestamp with time zone,
+			closed_at timestamp with time zone,
+			dump_name character varying,
+			dump_offset bigint,
+			document bytea
+		) ON COMMIT DROP`,
+	},
+	queries: []string{pq.CopyIn("tmp_gh_pull_requests", tmpPullRequestsFields...)},
+	copyIn:  true,
+	decode:  pullRequestsImporter.decode,
+	key:     pullRequestsImporter.key,
+	insert: func(txn *sql.Tx, stmts []*sql.Stmt, doc interface{}, o origin) error {
+		ghpr := doc.(ghPullRequest)
+
+		fullname := ghpr.Base.Repo.FullName
+		if fullname == "" {
+			fullname = ghpr.Owner + "/" + ghpr.Repo
+		}
+
+		_, err := stmts[0].Exec(
+			ghpr.ID,
+			removeNullByte(fullname),
+			nullIfEmpty(ghpr.Head.Repo.FullName),
+			ghpr.Number,
+			removeNullByte(ghpr.User.Login),
+			removeNullByte(ghpr.Title),
+			removeNullByte(ghpr.Body),
+			ghpr.State,
+			ghpr.Merged,
+			nullIfEmpty(ghpr.MergedAt),
+			removeNullByte(ghpr.Head.Ref),
+			ghpr.Head.SHA,
+			removeNullByte(ghpr.Base.Ref),
+			ghpr.Base.SHA,
+			nullIfEmpty(ghpr.CreatedAt),
+			nullIfEmpty(ghpr.UpdatedAt),
+			nullIfEmpty(ghpr.ClosedAt),
+			o.dump,
+			o.offset,
+			o.document())
+		if err != nil {
+			fail(err)
+			return fmt.Errorf("impossible to insert tmp pull request with github_id %d", ghpr.ID)
+		}
+		return nil
+	},
+	merge: []string{`
+		INSERT INTO gh_pull_requests (repository_id, head_repository_id, gh_user_id, github_id, number, title, body, state, merged, merged_at, head_ref, head_sha, base_ref, base_sha, created_at, updated_at, closed_at)
+		SELECT DISTINCT ON (tgpr.github_id)
+			gr.repository_id,
+			hgr.repository_id,
+			gu.id,
+			tgpr.github_id,
+			tgpr.number,
+			tgpr.title,
+			tgpr.body,
+			tgpr.state,
+			tgpr.merged,
+			tgpr.merged_at,
+			tgpr.head_ref,
+			tgpr.head_sha,
+			tgpr.base_ref,
+			tgpr.base_sha,
+			tgpr.created_at,
+			tgpr.updated_at,
+			tgpr.closed_at
+		FROM tmp_gh_pull_requests AS tgpr
+		INNER JOIN gh_repositories AS gr ON gr.full_name = tgpr.repository_full_name
+		LEFT JOIN gh_repositories AS hgr ON hgr.full_name = tgpr.head_repository_full_name
+		INNER JOIN gh_users AS gu ON gu.login = tgpr.login
+		LEFT JOIN gh_pull_requests AS gpr ON gpr.github_id = tgpr.github_id
+		WHERE gpr.id IS NULL
+		ORDER BY tgpr.github_id, tgpr.updated_at DESC NULLS LAST`,
+	},
+	unresolved: `
+		SELECT tgpr.dump_name, tgpr.dump_offset, tgpr.document
+		FROM tmp_gh_pull_requests AS tgpr
+		WHERE NOT EXISTS (SELECT 1 FROM gh_repositories AS gr WHERE gr.full_name = tgpr.repository_full_name)
+			OR NOT EXISTS (SELECT 1 FROM gh_users AS gu WHERE gu.login = tgpr.login)`,
+}
+
+// bulkPullRequestCommentsImporter is the bulk importer of review comments on
+// GitHub pull requests.
+var bulkPullRequestCommentsImporter = &importer{
+	constrained: pullRequestCommentsImporter.constrained,
+	setup: []string{`
+		CREATE TEMP TABLE tmp_gh_pull_request_comments (
+			github_id bigint NOT NULL,
+			repository_full_name character varying NOT NULL,
+			pull_request_number integer NOT NULL,
+			login character varying,
+			body text,
+			path character varying,
+			position integer,
+			commit_id character varying,
+			created_at timestamp with time zone,
+			updated_at timestamp with time zone,
+			dump_name character varying,
+			dump_offset bigint,
+			document bytea
+		) ON COMMIT DROP`,
+	},
+	queries: []string{pq.CopyIn("tmp_gh_pull_request_comments", tmpPullRequestCommentsFields...)},
+	copyIn:  true,
+	decode:  pullRequestCommentsImporter.decode,
+	key:     pullRequestCommentsImporter.key,
+	insert: func(txn *sql.Tx, stmts []*sql.Stmt, doc interface{}, o origin) error {
+		ghprc := doc.(ghPullRequestComment)
+		_, err := stmts[0].Exec(
+			ghprc.ID,
+			removeNullByte(ghprc.Owner+"/"+ghprc.Repo),
+			ghprc.PullReqID,
+			removeNullByte(ghprc.User.Login),
+			removeNullByte(ghprc.Body),
+			removeNullByte(ghprc.Path),
+			ghprc.Position,
+			nullIfEmpty(ghprc.CommitID),
+			nullIfEmpty(ghprc.CreatedAt),
+			nullIfEmpty(ghprc.UpdatedAt),
+			o.dump,
+			o.offset,
+			o.document())
+		if err != nil {
+			fail(err)
+			return fmt.Errorf("impossible to insert tmp pull request comment with github_id %d", ghprc.ID)
+		}
+		return nil
+	},
+	merge: []string{`
+		INSERT INTO gh_pull_request_comments (gh_pull_request_id, gh_user_id, github_id, body, path, position, commit_id, created_at, updated_at)
+		SELECT DISTINCT ON (tgprc.github_id)
+			gpr.id,
+			gu.id,
+			tgprc.github_id,
+			tgprc.body,
+			tgprc.path,
+			tgprc.position,
+			tgprc.commit_id,
+			tgprc.created_at,
+			tgprc.updated_at
+		FROM tmp_gh_pull_request_comments AS tgprc
+		INNER JOIN gh_repositories AS gr ON gr.full_name = tgprc.repository_full_name
+		INNER JOIN gh_pull_requests AS gpr ON (gpr.repository_id = gr.repository_id AND gpr.number = tgprc.pull_request_number)
+		INNER JOIN gh_users AS gu ON gu.login = tgprc.login
+		LEFT JOIN gh_pull_request_comments AS gprc ON gprc.github_id = tgprc.github_id
+		WHERE gprc.id IS NULL
+		ORDER BY tgprc.github_id, tgprc.updated_at DESC NULLS LAST`,
+	},
+	unresolved: `
+		SELECT tgprc.dump_name, tgprc.dump_offset, tgprc.document
+		FROM tmp_gh_pull_request_comments AS tgprc
+		WHERE NOT EXISTS (
+				SELECT 1
+				FROM gh_pull_requests AS gpr
+				INNER JOIN gh_repositories AS gr ON gr.repository_id = gpr.repository_id
+				WHERE gr.full_name = tgprc.repository_full_name AND gpr.number = tgprc.pull_request_number)
+			OR NOT EXISTS (SELECT 1 FROM gh_users AS gu WHERE gu.login = tgprc.login)`,
+}
@@ -0,0 +1,106 @@
+// Copyright 2014 The DevMine Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// checkpoint records, in the ght2dm_checkpoints table, how far the import of
+// a BSON dump went.
+//
+// A dump is identified by its entity, its date and the checksum of the file
+// it comes from, so that a dump that has been modified since it was imported,
+// for instance because it was downloaded again, is imported again. Offsets are
+// offsets within the decompressed dump, as returned by dumpReader.Offset.
+type checkpoint struct {
+	Entity    string
+	Date      time.Time
+	Checksum  string
+	Offset    int64 // offset of the first document that is not imported yet
+	Completed bool  // whether the whole dump has been imported
+}
+
+// loadCheckpoint loads the checkpoint of the dump of the given entity, date
+// and checksum. If the dump has never been imported, or if the documents it
+// contains were imported into a temporary staging table, the returned
+// checkpoint starts at the beginning of the dump.
+func loadCheckpoint(entity string, date time.Time, checksum string) (*checkpoint, error) {
+	cp := &checkpoint{Entity: entity, Date: date, Checksum: checksum}
+	err := db.QueryRow(`
+		SELECT byte_offset, completed
+		FROM ght2dm_checkpoints
+		WHERE entity=$1 AND dump_date=$2 AND checksum=$3
+	`, entity, date, checksum).Scan(&cp.Offset, &cp.Completed)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return cp, nil
+	case err != nil:
+		return nil, err
+	}
+
+	if isTempStaged(entity) {
+		cp.Offset, cp.Completed = 0, false
+	}
+	return cp, nil
+}
+
+// resume skips the documents of r that have already been imported, which may
+// only happen when the import was committed in batches (see
+// importDumpInBatches). A nil checkpoint, used for documents that are not read
+// from a dated dump, starts at the beginning.
+func (cp *checkpoint) resume(r *dumpReader) error {
+	if cp == nil || cp.Offset == 0 {
+		return nil
+	}
+	fmt.Printf("[%s] resuming at offset %d\n", cp.Entity, cp.Offset)
+	return r.Skip(cp.Offset)
+}
+
+// record saves, as part of txn, that the documents of the dump preceding
+// offset have been imported. completed tells whether the whole dump has been
+// imported. Nothing is recorded for a nil checkpoint.
+func (cp *checkpoint) record(txn *sql.Tx, offset int64, completed bool) error {
+	if cp == nil {
+		return nil
+	}
+
+	_, err := txn.Exec(`
+		INSERT INTO ght2dm_checkpoints(entity, dump_date, checksum, byte_offset, completed, updated_at)
+		VALUES($1, $2, $3, $4, $5, now())
+		ON CONFLICT (entity, dump_date, checksum)
+		DO UPDATE SET byte_offset=EXCLUDED.byte_offset, completed=EXCLUDED.completed, updated_at=EXCLUDED.updated_at
+	`, cp.Entity, cp.Date, cp.Checksum, offset, completed)
+	if err != nil {
+		return err
+	}
+
+	cp.Offset = offset
+	cp.Completed = completed
+	return nil
+}
+
+// fileChecksum computes the SHA-1 checksum of the file at path, as an
+// hexadecimal string.
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
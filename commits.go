@@ -0,0 +1,170 @@
+// Copyright 2014 The DevMine Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+	"labix.org/v2/mgo/bson"
+)
+
+type (
+	// ghCommit represents a commit of a GitHub repository.
+	ghCommit struct {
+		SHA string `bson:"sha"`
+		URL string `bson:"url"` // API URL of the commit
+
+		// Git commit
+		Commit struct {
+			Message   string          `bson:"message"`
+			Author    ghCommitSubject `bson:"author"`
+			Committer ghCommitSubject `bson:"committer"`
+		} `bson:"commit"`
+
+		// GitHub users corresponding to the commit author and committer. They
+		// are empty when the emails used for the commit are not associated
+		// with a GitHub account.
+		Author struct {
+			Login string `bson:"login"`
+		} `bson:"author"`
+		Committer struct {
+			Login string `bson:"login"`
+		} `bson:"committer"`
+
+		Stats struct {
+			Additions int64 `bson:"additions"`
+			Deletions int64 `bson:"deletions"`
+		} `bson:"stats"`
+
+		Files []struct {
+			Filename string `bson:"filename"`
+		} `bson:"files"`
+	}
+
+	// ghCommitSubject is the author or the committer of a git commit.
+	ghCommitSubject struct {
+		Name  string `bson:"name"`
+		Email string `bson:"email"`
+		Date  string `bson:"date"`
+	}
+)
+
+// tmpCommitsFields are the fields of the tmp_gh_commits table.
+var tmpCommitsFields = []string{
+	"repository_full_name",
+	"vcs_id",
+	"message",
+	"author_login",
+	"committer_login",
+	"author_date",
+	"commit_date",
+	"file_changed_count",
+	"insertions_count",
+	"deletions_count",
+	"dump_name",
+	"dump_offset",
+	"document",
+}
+
+// commitsImporter imports BSON dumps containing GitHub commits into the
+// DevMine database.
+//
+// Commits are inserted into the tmp_gh_commits table. They are linked to their
+// repository and to their author and committer when merged into the commits
+// table by insert_commits() (see staging).
+var commitsImporter = &importer{
+	queries: []string{pq.CopyIn("tmp_gh_commits", tmpCommitsFields...)},
+	copyIn:  true,
+	decode: func(bs []byte) (interface{}, error) {
+		ghc := ghCommit{}
+		err := bson.Unmarshal(bs, &ghc)
+		return ghc, err
+	},
+	insert: func(txn *sql.Tx, stmts []*sql.Stmt, doc interface{}, o origin) error {
+		ghc := doc.(ghCommit)
+		printVerbose("importing gh_commit with sha", ghc.SHA)
+		return insertTmpCommit(txn, stmts[0], ghc, o)
+	},
+	validate: func(doc interface{}) (string, error) {
+		_, err := validateTmpCommit(doc.(ghCommit))
+		return ghCommits, err
+	},
+}
+
+// commitRepoFullName returns the full name of the repository a commit belongs
+// to, as found in the API URL of the commit, or an empty string if the URL is
+// not a commit URL.
+//
+// Commit URLs look like https://api.github.com/repos/:owner/:repo/commits/:sha.
+func commitRepoFullName(ghc ghCommit) string {
+	const prefix = "https://api.github.com/repos/"
+	if !strings.HasPrefix(ghc.URL, prefix) {
+		return ""
+	}
+
+	parts := strings.Split(strings.TrimPrefix(ghc.URL, prefix), "/")
+	if len(parts) != 4 || parts[2] != "commits" || parts[0] == "" || parts[1] == "" || parts[3] == "" {
+		return ""
+	}
+	return parts[0] + "/" + parts[1]
+}
+
+// validateTmpCommit checks that a commit can be inserted into a temporary
+// table and returns the full name of its repository.
+func validateTmpCommit(ghc ghCommit) (string, error) {
+	if ghc.SHA == "" {
+		return "", errors.New("impossible to insert tmp commit without sha")
+	}
+
+	fullName := commitRepoFullName(ghc)
+	if fullName == "" {
+		return "", fmt.Errorf("impossible to find the repository of tmp commit with sha %s", ghc.SHA)
+	}
+	return fullName, nil
+}
+
+// insertTmpCommit inserts a commit, coming from o, into a temporary table in
+// the database.
+func insertTmpCommit(txn *sql.Tx, stmt *sql.Stmt, ghc ghCommit, o origin) error {
+	fullName, err := validateTmpCommit(ghc)
+	if err != nil {
+		return err
+	}
+
+	// Ensure that the dates are not empty strings "", otherwise PosgtreSQL fails
+	// to insert the new entry.
+	authorDate := &ghc.Commit.Author.Date
+	if *authorDate == "" {
+		authorDate = nil
+	}
+	commitDate := &ghc.Commit.Committer.Date
+	if *commitDate == "" {
+		commitDate = nil
+	}
+
+	_, err = stmt.Exec(
+		removeNullByte(fullName),
+		removeNullByte(ghc.SHA),
+		removeNullByte(ghc.Commit.Message),
+		removeNullByte(ghc.Author.Login),
+		removeNullByte(ghc.Committer.Login),
+		authorDate,
+		commitDate,
+		len(ghc.Files),
+		ghc.Stats.Additions,
+		ghc.Stats.Deletions,
+		o.dump,
+		o.offset,
+		o.document())
+	if err != nil {
+		fail(err)
+		return fmt.Errorf("impossible to insert tmp commit with sha %s", ghc.SHA)
+	}
+	return nil
+}
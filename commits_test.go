@@ -0,0 +1,46 @@
+// Copyright 2014 The DevMine Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestCommitRepoFullName(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://api.github.com/repos/DevMine/ght2dm/commits/6dcb09b5b57875f334f61aebed695e2e4193db5e", "DevMine/ght2dm"},
+		{"https://api.github.com/repos/foo/foo.github.io/commits/6dcb09b", "foo/foo.github.io"},
+		{"", ""},
+		{"https://api.github.com/repos/DevMine/ght2dm", ""},
+		{"https://api.github.com/repos/DevMine/ght2dm/commits", ""},
+		{"https://api.github.com/repos/DevMine/ght2dm/commits/", ""},
+		{"https://api.github.com/repos/DevMine/ght2dm/pulls/42", ""},
+		{"https://api.github.com/repos//ght2dm/commits/6dcb09b", ""},
+		{"https://api.github.com/repos/DevMine/ght2dm/commits/6dcb09b/comments", ""},
+		{"https://github.com/DevMine/ght2dm/commit/6dcb09b", ""},
+		{"DevMine/ght2dm/commits/6dcb09b", ""},
+	}
+	for _, tt := range tests {
+		if got := commitRepoFullName(ghCommit{URL: tt.url}); got != tt.want {
+			t.Errorf("commitRepoFullName(%q) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestValidateTmpCommit(t *testing.T) {
+	url := "https://api.github.com/repos/DevMine/ght2dm/commits/6dcb09b"
+
+	if _, err := validateTmpCommit(ghCommit{URL: url}); err == nil {
+		t.Error("commit without sha is valid")
+	}
+	if _, err := validateTmpCommit(ghCommit{SHA: "6dcb09b", URL: "https://github.com/DevMine/ght2dm"}); err == nil {
+		t.Error("commit without any commit URL is valid")
+	}
+	fullName, err := validateTmpCommit(ghCommit{SHA: "6dcb09b", URL: url})
+	if err != nil || fullName != "DevMine/ght2dm" {
+		t.Errorf("validateTmpCommit() = %q, %v, want DevMine/ght2dm", fullName, err)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2014 The DevMine Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// foreignKey is a foreign key constraint of a table written by an importer.
+type foreignKey struct {
+	table      string
+	name       string
+	deferrable bool
+}
+
+// deferredConstraints are the foreign key constraints deferred within the
+// transaction of a writer, which are checked before the savepoint of each
+// group of documents is released (see checks) instead of for every inserted
+// row.
+//
+// Constraints are never dropped: with -alterconstraints, those that are not
+// deferrable are made deferrable within the transaction itself, so that they
+// are restored by PostgreSQL if the transaction is rolled back, whether the
+// import fails, panics or is interrupted.
+type deferredConstraints struct {
+	fks     []foreignKey
+	altered []foreignKey // constraints made deferrable by the writer
+}
+
+// fetchForeignKeys returns the foreign key constraints of the given tables
+// visible in the current search path.
+func fetchForeignKeys(txn *sql.Tx, tables []string) ([]foreignKey, error) {
+	rows, err := txn.Query(`
+		SELECT rel.relname, con.conname, con.condeferrable
+		FROM pg_constraint AS con
+		INNER JOIN pg_class AS rel ON rel.oid = con.conrelid
+		WHERE con.contype = 'f' AND rel.relname = ANY($1) AND pg_table_is_visible(rel.oid)
+		ORDER BY rel.relname, con.conname
+	`, pq.Array(tables))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var fks []foreignKey
+	for rows.Next() {
+		var fk foreignKey
+		if err := rows.Scan(&fk.table, &fk.name, &fk.deferrable); err != nil {
+			return nil, err
+		}
+		fks = append(fks, fk)
+	}
+	return fks, rows.Err()
+}
+
+// deferConstraints defers the foreign key constraints of the given tables
+// within txn. When alter is true, the constraints that are not deferrable are
+// made deferrable until restore is called, which locks their table until the
+// end of the transaction; otherwise they are left as they are and checked for
+// every inserted row. Tables without any foreign key are ignored.
+func deferConstraints(txn *sql.Tx, tables []string, alter bool) (*deferredConstraints, error) {
+	dc := &deferredConstraints{}
+	if len(tables) == 0 {
+		return dc, nil
+	}
+
+	fks, err := fetchForeignKeys(txn, tables)
+	if err != nil {
+		return nil, err
+	}
+	for _, fk := range fks {
+		if !fk.deferrable {
+			if !alter {
+				continue
+			}
+			if _, err := txn.Exec("ALTER TABLE ONLY " + pq.QuoteIdentifier(fk.table) +
+				" ALTER CONSTRAINT " + pq.QuoteIdentifier(fk.name) + " DEFERRABLE"); err != nil {
+				return nil, err
+			}
+			dc.altered = append(dc.altered, fk)
+		}
+		dc.fks = append(dc.fks, fk)
+	}
+
+	if err := dc.set(txn, "DEFERRED"); err != nil {
+		return nil, err
+	}
+	return dc, nil
+}
+
+// checks returns the statements checking the deferred constraints for the
+// rows inserted so far and deferring them again, to be executed before
+// releasing a savepoint, so that a row violating them fails along with the
+// rows inserted within the savepoint instead of failing the whole
+// transaction once committed. It returns an empty string if no constraint is
+// deferred.
+func (dc *deferredConstraints) checks() string {
+	if len(dc.fks) == 0 {
+		return ""
+	}
+	names := dc.names()
+	return "SET CONSTRAINTS " + names + " IMMEDIATE; SET CONSTRAINTS " + names + " DEFERRED; "
+}
+
+// restore checks the deferred constraints and restores the constraints made
+// deferrable by deferConstraints as they were.
+func (dc *deferredConstraints) restore(txn *sql.Tx) error {
+	// Pending checks must be run before the constraints can be altered.
+	if err := dc.set(txn, "IMMEDIATE"); err != nil {
+		return err
+	}
+	for _, fk := range dc.altered {
+		if _, err := txn.Exec("ALTER TABLE ONLY " + pq.QuoteIdentifier(fk.table) +
+			" ALTER CONSTRAINT " + pq.QuoteIdentifier(fk.name) + " NOT DEFERRABLE"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// set sets the mode of the deferred constraints within txn.
+func (dc *deferredConstraints) set(txn *sql.Tx, mode string) error {
+	if len(dc.fks) == 0 {
+		return nil
+	}
+	_, err := txn.Exec("SET CONSTRAINTS " + dc.names() + " " + mode)
+	return err
+}
+
+// names returns the comma separated list of the names of the deferred
+// constraints.
+func (dc *deferredConstraints) names() string {
+	names := make([]string, len(dc.fks))
+	for i, fk := range dc.fks {
+		names[i] = pq.QuoteIdentifier(fk.name)
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,231 @@
+// Copyright 2014 The DevMine Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// deadLetter is a document rejected by an import, as written to the
+// dead-letter file given by the -deadletter option, one JSON object per line.
+type deadLetter struct {
+	Entity string `json:"entity"`
+	Source string `json:"source"` // dump the document comes from
+	Offset int64  `json:"offset"` // offset of the document within the dump
+	Reason string `json:"reason"` // see failureReason
+	Error  string `json:"error"`
+
+	// Document is the original BSON document, encoded in base64. It is empty
+	// for malformed documents, whose boundaries are unknown.
+	Document []byte `json:"document,omitempty"`
+}
+
+// deadLetters is the dead-letter file of the run, opened by the first
+// rejected document. Dumps may be imported concurrently.
+var deadLetters struct {
+	sync.Mutex
+	f   *os.File
+	err error
+}
+
+// writeDeadLetter writes a document of the given entity, found at offset in
+// the dump named source and rejected because of err, to the dead-letter file,
+// if any.
+func writeDeadLetter(entity, source string, offset int64, bs []byte, err error) {
+	if *deadLetterPath == "" {
+		return
+	}
+
+	dl := deadLetter{
+		Entity:   entity,
+		Source:   source,
+		Offset:   offset,
+		Reason:   failureReason(err),
+		Error:    err.Error(),
+		Document: bs,
+	}
+	line, jerr := json.Marshal(dl)
+	if jerr != nil {
+		fail("failed to encode dead letter: ", jerr)
+		return
+	}
+
+	deadLetters.Lock()
+	defer deadLetters.Unlock()
+
+	if deadLetters.f == nil && deadLetters.err == nil {
+		deadLetters.f, deadLetters.err = os.OpenFile(*deadLetterPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if deadLetters.err != nil {
+			fail("failed to open dead-letter file: ", deadLetters.err)
+		}
+	}
+	if deadLetters.err != nil {
+		return
+	}
+
+	// Each line is written at once, so that the file remains readable if
+	// the run is interrupted.
+	if _, err := deadLetters.f.Write(append(line, '\n')); err != nil {
+		fail("failed to write dead letter: ", err)
+	}
+}
+
+// origin locates a document within the dump it comes from. Importers copying
+// documents into staging tables copy their origin along with them, in the
+// dump_name, dump_offset and document columns, so that the rows that fail to
+// be merged can be written to the dead-letter file (see deadLetterRows).
+type origin struct {
+	dump   string // name of the dump, as in its report
+	offset int64
+	bs     []byte
+}
+
+// document returns the original document, which is only copied into staging
+// tables when rejected documents are written to a dead-letter file.
+func (o origin) document() []byte {
+	if *deadLetterPath == "" {
+		return nil
+	}
+	return o.bs
+}
+
+// deadLetterRows runs the query, within txn, returning the origin of the rows
+// of staging tables of the given entity that fail to be merged, writes them
+// to the dead-letter file and returns their number. Rows staged by previous
+// versions of ght2dm have no origin, and rows staged without a dead-letter
+// file have no document.
+func deadLetterRows(txn *sql.Tx, entity, query string) (int64, error) {
+	rows, err := txn.Query(query)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var n int64
+	for rows.Next() {
+		var (
+			dump   sql.NullString
+			offset sql.NullInt64
+			bs     []byte
+		)
+		if err := rows.Scan(&dump, &offset, &bs); err != nil {
+			return n, err
+		}
+		writeDeadLetter(entity, dump.String, offset.Int64, bs, errUnresolved)
+		n++
+	}
+	return n, rows.Err()
+}
+
+// closeDeadLetters closes the dead-letter file, if it has been opened.
+func closeDeadLetters() error {
+	deadLetters.Lock()
+	defer deadLetters.Unlock()
+
+	if deadLetters.f == nil {
+		return nil
+	}
+	return deadLetters.f.Close()
+}
+
+// scanDeadLetters reads the dead-letter file at path and calls fn with each of
+// its dead letters, until fn returns an error.
+func scanDeadLetters(path string, fn func(dl *deadLetter) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 2*(*maxDocSize)+1024)
+	for line := 1; sc.Scan(); line++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+
+		var dl deadLetter
+		if err := json.Unmarshal(sc.Bytes(), &dl); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		if _, ok := importers[dl.Entity]; !ok {
+			return fmt.Errorf("%s:%d: unsupported github entity %s", path, line, dl.Entity)
+		}
+		if err := fn(&dl); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+// openDeadLetters returns the documents of the given entity found in the
+// dead-letter file at path, concatenated as a BSON dump. The file is read as
+// the dump is, so that the documents are never all held in memory. Documents
+// without their original bytes are skipped.
+func openDeadLetters(path, entity string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(scanDeadLetters(path, func(dl *deadLetter) error {
+			if dl.Entity != entity || len(dl.Document) == 0 {
+				return nil
+			}
+			_, err := pw.Write(dl.Document)
+			return err
+		}))
+	}()
+	return pr
+}
+
+// scheduleReplay schedules the import of the documents of the dead-letter file
+// at path through the importers of their entity. Replayed documents are not
+// recorded in the checkpoints, and those that are rejected again are written
+// to the dead-letter file of the run, if any.
+//
+// The file is checked and its entities listed first, then read once more by
+// the import of each entity.
+func scheduleReplay(s *scheduler, path string) error {
+	replayed := make(map[string]bool)
+	err := scanDeadLetters(path, func(dl *deadLetter) error {
+		if len(dl.Document) == 0 {
+			fmt.Printf("[%s] skipped document at offset %d of '%s': no document\n", dl.Entity, dl.Offset, dl.Source)
+			return nil
+		}
+		replayed[dl.Entity] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, entity := range entities {
+		if !replayed[entity] {
+			continue
+		}
+
+		entity := entity
+		name := path + ":" + entity
+		s.add(entity, func() {
+			fmt.Printf("[%s] replaying '%s'\n", entity, path)
+			dump := openDeadLetters(path, entity)
+			defer dump.Close()
+
+			rep := report.startDump(entity, name)
+			err := importerFor(entity).importDump(dump, nil, rep)
+			rep.finish(err)
+			if err != nil {
+				fail(fmt.Sprintf("failed to replay '%s': %v", name, err))
+				importFailed(err)
+			}
+		})
+	}
+	return nil
+}
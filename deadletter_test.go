@@ -0,0 +1,134 @@
+// Copyright 2014 The DevMine Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// withDeadLetters sets the dead-letter file of the run to a new file for the
+// duration of f, and returns its dead letters.
+func withDeadLetters(t *testing.T, f func()) []deadLetter {
+	dir, err := ioutil.TempDir("", "ght2dm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "rejected.jsonl")
+	defer func(orig string) {
+		*deadLetterPath = orig
+		deadLetters.f, deadLetters.err = nil, nil
+	}(*deadLetterPath)
+	*deadLetterPath = path
+
+	f()
+	if err := closeDeadLetters(); err != nil {
+		t.Fatal(err)
+	}
+
+	var dls []deadLetter
+	if err := scanDeadLetters(path, func(dl *deadLetter) error {
+		dls = append(dls, *dl)
+		return nil
+	}); err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return dls
+}
+
+func TestDeadLetterRows(t *testing.T) {
+	doc := marshalDoc(t, bson.M{"login": "foo"})
+
+	dls := withDeadLetters(t, func() {
+		withFakeDB(t, nil, func(fdb *fakeDB) {
+			fdb.unresolved = [][]driver.Value{
+				{"2014-01-01.bson", int64(42), doc},
+				{nil, nil, nil}, // staged by a previous version
+			}
+
+			txn, err := db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer txn.Rollback()
+
+			n, err := deadLetterRows(txn, ghFollowers, "SELECT dump_name, dump_offset, document FROM tmp_gh_followers")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 2 {
+				t.Errorf("got %d unresolved rows, want 2", n)
+			}
+		})
+	})
+
+	reason := errUnresolved.Error()
+	want := []deadLetter{
+		{Entity: ghFollowers, Source: "2014-01-01.bson", Offset: 42, Reason: reason, Error: reason, Document: doc},
+		{Entity: ghFollowers, Reason: reason, Error: reason},
+	}
+	if !reflect.DeepEqual(dls, want) {
+		t.Errorf("got dead letters %+v, want %+v", dls, want)
+	}
+}
+
+func TestOpenDeadLetters(t *testing.T) {
+	docs := [][]byte{
+		marshalDoc(t, bson.M{"login": "foo"}),
+		marshalDoc(t, bson.M{"login": "bar"}),
+		marshalDoc(t, bson.M{"login": "baz"}),
+	}
+	letters := []deadLetter{
+		{Entity: ghFollowers, Source: "a.bson", Document: docs[0]},
+		{Entity: ghUsers, Source: "b.bson", Document: docs[1]},
+		{Entity: ghFollowers, Source: "a.bson"}, // malformed
+		{Entity: ghFollowers, Source: "c.bson", Document: docs[2]},
+	}
+
+	dir, err := ioutil.TempDir("", "ght2dm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	for _, dl := range letters {
+		line, err := json.Marshal(dl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(append(line, '\n'))
+	}
+	path := filepath.Join(dir, "rejected.jsonl")
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dump := openDeadLetters(path, ghFollowers)
+	got, err := ioutil.ReadAll(dump)
+	dump.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := concat(docs[0], docs[2]); !bytes.Equal(got, want) {
+		t.Errorf("got dump %v, want %v", got, want)
+	}
+
+	// The reader can be closed before the end of the file.
+	dump = openDeadLetters(path, ghFollowers)
+	if err := dump.Close(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2014 The DevMine Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// maxDryRunReasons is the maximum number of distinct reasons printed for each
+// class of failures of an entity in dry-run mode.
+const maxDryRunReasons = 10
+
+// Classes of failures of dry runs
+const (
+	failMalformed = "malformed documents" // documents that cannot be read
+	failDecode    = "decode failures"     // documents that cannot be decoded
+	failInvalid   = "invalid documents"   // documents that would be rejected
+)
+
+// dryRunCounts holds the counts of the documents of a GitHub entity read in
+// dry-run mode.
+type dryRunCounts struct {
+	dumps int
+	docs  int
+	kinds map[string]int // valid documents by kind
+
+	// failed documents by class of failure and by reason
+	failures map[string]map[string]int
+}
+
+func newDryRunCounts() *dryRunCounts {
+	return &dryRunCounts{
+		kinds:    make(map[string]int),
+		failures: make(map[string]map[string]int),
+	}
+}
+
+// fail counts a document that failed for the given class and reason.
+func (c *dryRunCounts) fail(class, reason string) {
+	if c.failures[class] == nil {
+		c.failures[class] = make(map[string]int)
+	}
+	c.failures[class][reason]++
+}
+
+// add adds the counts of o to c.
+func (c *dryRunCounts) add(o *dryRunCounts) {
+	c.dumps += o.dumps
+	c.docs += o.docs
+	for kind, n := range o.kinds {
+		c.kinds[kind] += n
+	}
+	for class, reasons := range o.failures {
+		for reason, n := range reasons {
+			if c.failures[class] == nil {
+				c.failures[class] = make(map[string]int)
+			}
+			c.failures[class][reason] += n
+		}
+	}
+}
+
+// dryRuns holds the counts of the dry run, by entity. Dumps of different
+// entities may be read concurrently.
+var dryRuns = struct {
+	sync.Mutex
+	counts map[string]*dryRunCounts
+}{counts: make(map[string]*dryRunCounts)}
+
+// addDryRunCounts adds the counts of a dump of the given entity to the counts
+// of the dry run.
+func addDryRunCounts(entity string, c *dryRunCounts) {
+	dryRuns.Lock()
+	defer dryRuns.Unlock()
+
+	if dryRuns.counts[entity] == nil {
+		dryRuns.counts[entity] = newDryRunCounts()
+	}
+	dryRuns.counts[entity].add(c)
+}
+
+// dryRunDumpFile reads the BSON dump file at path, which contains documents of
+// the given GitHub entity, without importing it.
+func dryRunDumpFile(entity, path string) error {
+	fmt.Printf("[%s] checking '%s'\n", entity, filepath.Base(path))
+
+	f, err := openDump(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return importers[entity].dryRun(f, path, entity)
+}
+
+// dryRun reads the BSON dump read from f, decodes and validates its documents
+// the same way importDump does, without accessing the database, and adds the
+// counts of its documents to the counts of the dry run. The name is only used
+// to identify the dump in messages.
+func (imp *importer) dryRun(f io.Reader, name, entity string) error {
+	c := newDryRunCounts()
+	c.dumps = 1
+	defer addDryRunCounts(entity, c)
+
+	r := newDumpReader(f, *maxDocSize)
+	for {
+		bs, err := r.ReadDoc()
+		if err == io.EOF {
+			return nil
+		}
+		if merr, ok := err.(*malformedDocError); ok {
+			c.docs++
+			c.fail(failMalformed, merr.Reason)
+			printVerbose(name, ": ", err)
+			continue
+		} else if err != nil {
+			return err
+		}
+		c.docs++
+
+		doc, err := imp.decode(bs)
+		if err != nil {
+			c.fail(failDecode, err.Error())
+			printVerbose(name, ": ", err)
+			continue
+		}
+
+		kind := entity
+		if imp.validate != nil {
+			if kind, err = imp.validate(doc); err != nil {
+				c.fail(failInvalid, err.Error())
+				printVerbose(name, ": ", err)
+				continue
+			}
+		}
+		c.kinds[kind]++
+	}
+}
+
+// printDryRunCounts prints the counts of the documents read by the dry run,
+// for each entity.
+func printDryRunCounts() {
+	dryRuns.Lock()
+	defer dryRuns.Unlock()
+
+	for _, entity := range entities {
+		c, ok := dryRuns.counts[entity]
+		if !ok {
+			continue
+		}
+
+		fmt.Printf("%s: %d documents in %d dumps\n", entity, c.docs, c.dumps)
+		for _, kind := range sortedKeys(c.kinds) {
+			fmt.Printf("\t%d %s\n", c.kinds[kind], kind)
+		}
+		for _, class := range []string{failMalformed, failDecode, failInvalid} {
+			reasons := c.failures[class]
+			if len(reasons) == 0 {
+				continue
+			}
+
+			var total int
+			for _, n := range reasons {
+				total += n
+			}
+			fmt.Printf("\t%d %s\n", total, class)
+
+			// most frequent reasons first
+			rs := sortedKeys(reasons)
+			sort.SliceStable(rs, func(i, j int) bool { return reasons[rs[i]] > reasons[rs[j]] })
+			for i, reason := range rs {
+				if i == maxDryRunReasons {
+					fmt.Printf("\t\t... and %d other reasons\n", len(rs)-i)
+					break
+				}
+				fmt.Printf("\t\t%d %s\n", reasons[reason], reason)
+			}
+		}
+	}
+}
+
+// sortedKeys returns the keys of m in alphabetical order.
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,108 @@
+// Copyright 2014 The DevMine Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// dumpNameRegexp matches the name of a BSON dump file. The name is made of
+// the creation date of the dump, using the format yyyy-mm-dd, followed by the
+// .bson extension and, when the dump is compressed, by the extension of the
+// compression format.
+var dumpNameRegexp = regexp.MustCompile(`^([0-9]{4}-[0-9]{2}-[0-9]{2})\.bson(\.gz|\.bz2|\.xz|\.zst)?$`)
+
+// isDumpName tells whether name is a valid BSON dump file name.
+func isDumpName(name string) bool {
+	return dumpNameRegexp.MatchString(name)
+}
+
+// dumpDate returns the creation date of the dump named name.
+func dumpDate(name string) (time.Time, error) {
+	m := dumpNameRegexp.FindStringSubmatch(name)
+	if m == nil {
+		return time.Time{}, errors.New("invalid dump name " + name)
+	}
+	return time.Parse("2006-01-02", m[1])
+}
+
+// dumpFile is a BSON dump file opened for reading. When the file is
+// compressed, reads return the decompressed stream.
+type dumpFile struct {
+	io.Reader
+
+	// closers are closed in reverse order when the dump file is closed.
+	closers []io.Closer
+}
+
+// openDump opens the BSON dump file at path. The compression format, if any,
+// is inferred from the file extension and the content of the file is
+// decompressed on the fly.
+func openDump(path string) (*dumpFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	df := &dumpFile{closers: []io.Closer{f}}
+	if df.Reader, err = df.decompress(f, filepath.Ext(path)); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return df, nil
+}
+
+// decompress returns a reader that decompresses r according to the
+// compression format corresponding to the file extension ext. Decompressors
+// that need to be closed are closed along with the dump file.
+//
+// r is returned as is when ext does not correspond to a compression format.
+func (df *dumpFile) decompress(r io.Reader, ext string) (io.Reader, error) {
+	switch ext {
+	case ".gz":
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		df.closers = append(df.closers, zr)
+		return zr, nil
+	case ".bz2":
+		return bzip2.NewReader(r), nil
+	case ".xz":
+		return xz.NewReader(r)
+	case ".zst":
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		rc := zr.IOReadCloser()
+		df.closers = append(df.closers, rc)
+		return rc, nil
+	}
+
+	return r, nil
+}
+
+// Close closes the dump file and the decompressors it uses.
+func (df *dumpFile) Close() error {
+	var err error
+	for i := len(df.closers) - 1; i >= 0; i-- {
+		if cerr := df.closers[i].Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,71 @@
+// Copyright 2014 The DevMine Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Orders in which dated dumps and archives are imported
+const (
+	orderDesc = "desc" // from the newest to the oldest
+	orderAsc  = "asc"  // from the oldest to the newest
+)
+
+// Bounds of the range of dates of the dumps and archives to import, set from
+// the command line by checkDumpOrder. A zero bound means no bound.
+var (
+	sinceDate time.Time
+	untilDate time.Time
+)
+
+// checkDumpOrder checks the order and the range of dates of the dumps given on
+// the command line.
+func checkDumpOrder() error {
+	switch *order {
+	case orderDesc, orderAsc:
+	default:
+		return errors.New("invalid order " + *order + " (expected asc or desc)")
+	}
+
+	var err error
+	if *since != "" {
+		if sinceDate, err = time.Parse("2006-01-02", *since); err != nil {
+			return fmt.Errorf("invalid -since date: %v", err)
+		}
+	}
+	if *until != "" {
+		if untilDate, err = time.Parse("2006-01-02", *until); err != nil {
+			return fmt.Errorf("invalid -until date: %v", err)
+		}
+	}
+	if !sinceDate.IsZero() && !untilDate.IsZero() && sinceDate.After(untilDate) {
+		return errors.New("-since date is after -until date")
+	}
+	return nil
+}
+
+// inDateRange tells whether a dump or an archive of the given date must be
+// imported. Both bounds of the range are inclusive.
+func inDateRange(date time.Time) bool {
+	if !sinceDate.IsZero() && date.Before(sinceDate) {
+		return false
+	}
+	if !untilDate.IsZero() && date.After(untilDate) {
+		return false
+	}
+	return true
+}
+
+// dumpBefore tells whether a dump or an archive of date di must be imported
+// before one of date dj.
+func dumpBefore(di, dj time.Time) bool {
+	if *order == orderAsc {
+		return di.Before(dj)
+	}
+	return di.After(dj)
+}
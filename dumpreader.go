@@ -0,0 +1,284 @@
+// Copyright 2014 The DevMine Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Sizes of BSON documents.
+const (
+	// minDocSize is the size of the smallest BSON document: an empty document
+	// made of the 4 bytes length field and the 0x00 terminator.
+	minDocSize = 5
+
+	// defaultMaxDocSize is the default maximum size of a BSON document. It
+	// matches the maximum size of a MongoDB document.
+	defaultMaxDocSize = 16 * 1024 * 1024
+
+	// initialBufSize is the initial size of the buffer of a dumpReader. The
+	// buffer only grows when a bigger document has to be peeked as a whole.
+	initialBufSize = 64 * 1024
+)
+
+// maxEmptyReads is the number of consecutive reads returning neither data nor
+// an error after which a dumpReader gives up with io.ErrNoProgress.
+const maxEmptyReads = 100
+
+// malformedDocError is returned by dumpReader.ReadDoc when the document found
+// at a given offset of the dump is not a valid BSON document.
+type malformedDocError struct {
+	Offset int64  // offset of the document within the dump
+	Reason string // why the document is considered malformed
+}
+
+func (e *malformedDocError) Error() string {
+	return fmt.Sprintf("malformed bson document at offset %d: %s", e.Offset, e.Reason)
+}
+
+// dumpReader is a streaming reader for BSON dumps, as produced by mongodump.
+//
+// A BSON dump is a plain concatenation of BSON documents, each starting with
+// its length as a little endian int32 and ending with a 0x00 byte. When a
+// malformed document is encountered, ReadDoc returns a *malformedDocError and
+// the next call to ReadDoc skips ahead to the next plausible document boundary,
+// so that one damaged document does not prevent reading the rest of the dump.
+type dumpReader struct {
+	r          io.Reader
+	maxDocSize int
+
+	// buf[start:end] holds the bytes read from r but not consumed yet.
+	buf        []byte
+	start, end int
+
+	// err is the error returned by r, reported once the buffered bytes are
+	// consumed.
+	err error
+
+	// offset is the offset, within the dump, of the next byte to be read.
+	offset int64
+
+	// resync is set when the document at offset is malformed and that the
+	// next call to ReadDoc must look for the next document boundary.
+	resync bool
+}
+
+// newDumpReader creates a new dumpReader that reads from r and rejects
+// documents bigger than maxDocSize bytes. If maxDocSize is not a valid size,
+// defaultMaxDocSize is used instead.
+func newDumpReader(r io.Reader, maxDocSize int) *dumpReader {
+	if maxDocSize < minDocSize {
+		maxDocSize = defaultMaxDocSize
+	}
+
+	size := initialBufSize
+	if size > maxDocSize {
+		size = maxDocSize
+	}
+	return &dumpReader{r: r, maxDocSize: maxDocSize, buf: make([]byte, size)}
+}
+
+// peek returns the next n bytes of the dump without consuming them. If fewer
+// than n bytes are left, it returns them along with the error of the
+// underlying reader, io.EOF at the end of the dump.
+//
+// A whole document is peeked so that it can be validated before being
+// consumed, which allows to resynchronize right after the beginning of a
+// malformed document. The buffer grows accordingly, up to maxDocSize.
+func (dr *dumpReader) peek(n int) ([]byte, error) {
+	for empty := 0; dr.end-dr.start < n && dr.err == nil; {
+		if n > len(dr.buf)-dr.start {
+			buf := dr.buf
+			if n > len(buf) {
+				size := 2 * len(buf)
+				if size > dr.maxDocSize {
+					size = dr.maxDocSize
+				}
+				if size < n {
+					size = n
+				}
+				buf = make([]byte, size)
+			}
+			dr.end = copy(buf, dr.buf[dr.start:dr.end])
+			dr.start = 0
+			dr.buf = buf
+		}
+
+		m, err := dr.r.Read(dr.buf[dr.end:])
+		dr.end += m
+		switch {
+		case err != nil:
+			dr.err = err
+		case m > 0:
+			empty = 0
+		default:
+			if empty++; empty >= maxEmptyReads {
+				dr.err = io.ErrNoProgress
+			}
+		}
+	}
+
+	if avail := dr.end - dr.start; avail < n {
+		return dr.buf[dr.start:dr.end], dr.err
+	}
+	return dr.buf[dr.start : dr.start+n], nil
+}
+
+// discard consumes the next n bytes of the dump, which must have been peeked.
+func (dr *dumpReader) discard(n int) {
+	dr.start += n
+	dr.offset += int64(n)
+}
+
+// Offset returns the offset, within the dump, of the next document to be
+// read.
+func (dr *dumpReader) Offset() int64 {
+	return dr.offset
+}
+
+// Skip skips the next n bytes of the dump, which must be the boundary of a
+// document, typically the offset of a document that was read previously.
+func (dr *dumpReader) Skip(n int64) error {
+	buffered := dr.end - dr.start
+	if int64(buffered) > n {
+		buffered = int(n)
+	}
+	dr.discard(buffered)
+
+	skipped, err := int64(buffered), dr.err
+	if skipped < n && err == nil {
+		var m int64
+		m, err = io.CopyN(ioutil.Discard, dr.r, n-skipped)
+		skipped += m
+		dr.offset += m
+	}
+	switch {
+	case skipped == n:
+		return nil
+	case err == io.EOF:
+		return fmt.Errorf("cannot skip to offset %d: the dump is only %d bytes long", n, skipped)
+	}
+	return err
+}
+
+// ReadDoc reads the next BSON document.
+//
+// It returns io.EOF when there is no more document to read and a
+// *malformedDocError when the next document is not a valid BSON document.
+// Any other error comes from the underlying reader.
+func (dr *dumpReader) ReadDoc() ([]byte, error) {
+	if dr.resync {
+		if err := dr.skipToNextDoc(); err != nil {
+			return nil, err
+		}
+	}
+
+	lenBuf, err := dr.peek(4)
+	switch {
+	case err == io.EOF && len(lenBuf) == 0:
+		return nil, io.EOF
+	case err == io.EOF:
+		return nil, dr.malformed("truncated length field")
+	case err != nil:
+		return nil, err
+	}
+
+	docLen := int(int32(binary.LittleEndian.Uint32(lenBuf)))
+	if docLen < minDocSize || docLen > dr.maxDocSize {
+		return nil, dr.malformed(fmt.Sprintf("invalid document length %d", docLen))
+	}
+
+	// The length field is part of the document and it is expected by
+	// bson.Unmarshal, so the document is peeked as a whole.
+	buf, err := dr.peek(docLen)
+	switch {
+	case err == io.EOF:
+		return nil, dr.malformed(fmt.Sprintf("truncated document: expected %d bytes, got %d", docLen, len(buf)))
+	case err != nil:
+		return nil, err
+	}
+
+	if buf[docLen-1] != 0x00 {
+		return nil, dr.malformed("missing document terminator")
+	}
+
+	doc := make([]byte, docLen)
+	copy(doc, buf)
+	dr.discard(docLen)
+
+	return doc, nil
+}
+
+// malformed returns a *malformedDocError for the document at the current
+// offset and schedules a resynchronization.
+func (dr *dumpReader) malformed(reason string) error {
+	dr.resync = true
+	return &malformedDocError{Offset: dr.offset, Reason: reason}
+}
+
+// skipToNextDoc skips the malformed document at the current offset and
+// advances to the next offset that looks like the beginning of a BSON document.
+//
+// It returns io.EOF if no such offset is found before the end of the dump.
+func (dr *dumpReader) skipToNextDoc() error {
+	for {
+		if _, err := dr.peek(1); err != nil {
+			return err
+		}
+		dr.discard(1)
+
+		ok, err := dr.atDocBoundary()
+		if err != nil {
+			return err
+		}
+		if ok {
+			dr.resync = false
+			return nil
+		}
+	}
+}
+
+// atDocBoundary tells whether the bytes at the current offset look like the
+// beginning of a BSON document: a valid length, a valid type for the first
+// element and a 0x00 terminator at the end.
+func (dr *dumpReader) atDocBoundary() (bool, error) {
+	hdr, err := dr.peek(5)
+	if err == io.EOF {
+		if len(hdr) == 0 {
+			return false, io.EOF
+		}
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	docLen := int(int32(binary.LittleEndian.Uint32(hdr)))
+	if docLen < minDocSize || docLen > dr.maxDocSize {
+		return false, nil
+	}
+	if docLen == minDocSize && hdr[4] != 0x00 {
+		return false, nil
+	}
+	if docLen > minDocSize && !isBSONElemType(hdr[4]) {
+		return false, nil
+	}
+
+	buf, err := dr.peek(docLen)
+	if err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return buf[docLen-1] == 0x00, nil
+}
+
+// isBSONElemType tells whether b is a valid BSON element type.
+func isBSONElemType(b byte) bool {
+	return (b >= 0x01 && b <= 0x13) || b == 0x7f || b == 0xff
+}
@@ -0,0 +1,271 @@
+// Copyright 2014 The DevMine Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+	"testing/iotest"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// marshalDoc returns the BSON encoding of doc.
+func marshalDoc(t *testing.T, doc interface{}) []byte {
+	bs, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bs
+}
+
+// concat returns the concatenation of the given byte slices.
+func concat(bss ...[]byte) []byte {
+	return bytes.Join(bss, nil)
+}
+
+// readDump reads all the documents of dr until io.EOF and returns them along
+// with the malformed document errors returned in between.
+func readDump(t *testing.T, dr *dumpReader) ([][]byte, []*malformedDocError) {
+	var (
+		docs [][]byte
+		errs []*malformedDocError
+	)
+	for i := 0; i < 100; i++ {
+		doc, err := dr.ReadDoc()
+		switch err := err.(type) {
+		case nil:
+			docs = append(docs, doc)
+		case *malformedDocError:
+			errs = append(errs, err)
+		default:
+			if err == io.EOF {
+				return docs, errs
+			}
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	t.Fatal("ReadDoc never returned io.EOF")
+	return nil, nil
+}
+
+func TestDumpReaderShortReads(t *testing.T) {
+	docs := [][]byte{
+		marshalDoc(t, bson.M{"login": "foo"}),
+		marshalDoc(t, bson.M{}),
+		marshalDoc(t, bson.M{"login": "bar", "id": 42}),
+	}
+	dump := concat(docs...)
+
+	readers := map[string]io.Reader{
+		"one byte": iotest.OneByteReader(bytes.NewReader(dump)),
+		"half":     iotest.HalfReader(bytes.NewReader(dump)),
+		"data err": iotest.DataErrReader(bytes.NewReader(dump)),
+	}
+	for name, r := range readers {
+		dr := newDumpReader(r, 0)
+		got, errs := readDump(t, dr)
+		if len(errs) != 0 {
+			t.Errorf("%s reader: unexpected malformed documents: %v", name, errs)
+		}
+		if !reflect.DeepEqual(got, docs) {
+			t.Errorf("%s reader: got documents %v, want %v", name, got, docs)
+		}
+		if dr.Offset() != int64(len(dump)) {
+			t.Errorf("%s reader: got offset %d, want %d", name, dr.Offset(), len(dump))
+		}
+	}
+}
+
+func TestDumpReaderInvalidLength(t *testing.T) {
+	doc1 := marshalDoc(t, bson.M{"login": "foo"})
+	doc2 := marshalDoc(t, bson.M{"login": "bar"})
+
+	tests := []struct {
+		length []byte
+		reason string
+	}{
+		{[]byte{0x02, 0x00, 0x00, 0x00}, "invalid document length 2"},
+		{[]byte{0xff, 0xff, 0xff, 0xff}, "invalid document length -1"},
+		{[]byte{0x00, 0x00, 0x00, 0x7f}, "invalid document length 2130706432"},
+	}
+	for _, tt := range tests {
+		dr := newDumpReader(bytes.NewReader(concat(doc1, tt.length, doc2)), 0)
+		docs, errs := readDump(t, dr)
+		if !reflect.DeepEqual(docs, [][]byte{doc1, doc2}) {
+			t.Errorf("length %v: got documents %v, want %v", tt.length, docs, [][]byte{doc1, doc2})
+		}
+		want := []*malformedDocError{{Offset: int64(len(doc1)), Reason: tt.reason}}
+		if !reflect.DeepEqual(errs, want) {
+			t.Errorf("length %v: got errors %v, want %v", tt.length, errs, want)
+		}
+	}
+}
+
+func TestDumpReaderMaxDocSize(t *testing.T) {
+	small := marshalDoc(t, bson.M{"a": 1})
+	big := marshalDoc(t, bson.M{"login": "a rather long login"})
+
+	dr := newDumpReader(bytes.NewReader(concat(small, big, small)), len(small))
+	docs, errs := readDump(t, dr)
+	if !reflect.DeepEqual(docs, [][]byte{small, small}) {
+		t.Errorf("got documents %v, want %v", docs, [][]byte{small, small})
+	}
+	if len(errs) != 1 || errs[0].Offset != int64(len(small)) {
+		t.Errorf("got errors %v, want a single error at offset %d", errs, len(small))
+	}
+}
+
+func TestDumpReaderMissingTerminator(t *testing.T) {
+	doc1 := marshalDoc(t, bson.M{"login": "foo"})
+	doc3 := marshalDoc(t, bson.M{"login": "bar"})
+
+	doc2 := marshalDoc(t, bson.M{"a": 1})
+	doc2[len(doc2)-1] = 0x01
+
+	dr := newDumpReader(bytes.NewReader(concat(doc1, doc2, doc3)), 0)
+	docs, errs := readDump(t, dr)
+	if !reflect.DeepEqual(docs, [][]byte{doc1, doc3}) {
+		t.Errorf("got documents %v, want %v", docs, [][]byte{doc1, doc3})
+	}
+	want := []*malformedDocError{{Offset: int64(len(doc1)), Reason: "missing document terminator"}}
+	if !reflect.DeepEqual(errs, want) {
+		t.Errorf("got errors %v, want %v", errs, want)
+	}
+}
+
+func TestDumpReaderResync(t *testing.T) {
+	doc1 := marshalDoc(t, bson.M{"login": "foo"})
+	doc2 := marshalDoc(t, bson.M{"login": "bar"})
+	doc3 := marshalDoc(t, bson.M{"login": "baz"})
+	garbage := []byte("not a bson document")
+	dump := concat(doc1, garbage, doc2, doc3)
+
+	dr := newDumpReader(bytes.NewReader(dump), 0)
+
+	doc, err := dr.ReadDoc()
+	if err != nil || !bytes.Equal(doc, doc1) {
+		t.Fatalf("got document %v (error %v), want %v", doc, err, doc1)
+	}
+
+	_, err = dr.ReadDoc()
+	merr, ok := err.(*malformedDocError)
+	if !ok {
+		t.Fatalf("got error %v, want a malformed document error", err)
+	}
+	if merr.Offset != int64(len(doc1)) {
+		t.Errorf("got malformed document at offset %d, want %d", merr.Offset, len(doc1))
+	}
+
+	// The reader skips the garbage and resumes at the next valid document.
+	doc, err = dr.ReadDoc()
+	if err != nil || !bytes.Equal(doc, doc2) {
+		t.Fatalf("got document %v (error %v), want %v", doc, err, doc2)
+	}
+	if want := int64(len(doc1) + len(garbage) + len(doc2)); dr.Offset() != want {
+		t.Errorf("got offset %d after resync, want %d", dr.Offset(), want)
+	}
+
+	docs, errs := readDump(t, dr)
+	if len(errs) != 0 || !reflect.DeepEqual(docs, [][]byte{doc3}) {
+		t.Errorf("got documents %v and errors %v, want %v", docs, errs, [][]byte{doc3})
+	}
+	if dr.Offset() != int64(len(dump)) {
+		t.Errorf("got offset %d, want %d", dr.Offset(), len(dump))
+	}
+}
+
+func TestDumpReaderTruncatedDoc(t *testing.T) {
+	doc1 := marshalDoc(t, bson.M{"login": "foo"})
+	doc2 := marshalDoc(t, bson.M{"login": "bar"})
+
+	tests := []struct {
+		trailing []byte
+		reason   string
+	}{
+		{doc2[:len(doc2)-3], fmt.Sprintf("truncated document: expected %d bytes, got %d", len(doc2), len(doc2)-3)},
+		{doc2[:2], "truncated length field"},
+	}
+	for _, tt := range tests {
+		dr := newDumpReader(bytes.NewReader(concat(doc1, tt.trailing)), 0)
+		docs, errs := readDump(t, dr)
+		if !reflect.DeepEqual(docs, [][]byte{doc1}) {
+			t.Errorf("%d trailing bytes: got documents %v, want %v", len(tt.trailing), docs, [][]byte{doc1})
+		}
+		want := []*malformedDocError{{Offset: int64(len(doc1)), Reason: tt.reason}}
+		if !reflect.DeepEqual(errs, want) {
+			t.Errorf("%d trailing bytes: got errors %v, want %v", len(tt.trailing), errs, want)
+		}
+	}
+}
+
+func TestDumpReaderSkip(t *testing.T) {
+	doc1 := marshalDoc(t, bson.M{"login": "foo"})
+	doc2 := marshalDoc(t, bson.M{"login": "bar"})
+
+	dr := newDumpReader(bytes.NewReader(concat(doc1, doc2)), 0)
+	if err := dr.Skip(int64(len(doc1))); err != nil {
+		t.Fatal(err)
+	}
+	docs, errs := readDump(t, dr)
+	if len(errs) != 0 || !reflect.DeepEqual(docs, [][]byte{doc2}) {
+		t.Errorf("got documents %v and errors %v, want %v", docs, errs, [][]byte{doc2})
+	}
+
+	dr = newDumpReader(bytes.NewReader(doc1), 0)
+	if err := dr.Skip(int64(len(doc1) + 1)); err == nil {
+		t.Error("skipping past the end of the dump succeeded")
+	}
+}
+
+func TestDumpReaderBufferGrowth(t *testing.T) {
+	small := marshalDoc(t, bson.M{"login": "foo"})
+	big := marshalDoc(t, bson.M{"bio": string(bytes.Repeat([]byte("a"), 3*initialBufSize))})
+	dump := concat(small, big, small)
+
+	dr := newDumpReader(iotest.HalfReader(bytes.NewReader(dump)), 0)
+	if len(dr.buf) != initialBufSize {
+		t.Errorf("got a buffer of %d bytes, want %d", len(dr.buf), initialBufSize)
+	}
+	docs, errs := readDump(t, dr)
+	if len(errs) != 0 || !reflect.DeepEqual(docs, [][]byte{small, big, small}) {
+		t.Errorf("got %d documents and errors %v, want the 3 documents of the dump", len(docs), errs)
+	}
+	if len(dr.buf) < len(big) || len(dr.buf) > 2*len(big) {
+		t.Errorf("got a buffer of %d bytes after reading a document of %d bytes", len(dr.buf), len(big))
+	}
+
+	// The buffer never grows past the maximum document size.
+	dr = newDumpReader(bytes.NewReader(dump), len(big)-1)
+	docs, errs = readDump(t, dr)
+	if len(errs) != 1 || !reflect.DeepEqual(docs, [][]byte{small, small}) {
+		t.Errorf("got %d documents and errors %v, want 2 documents and 1 error", len(docs), errs)
+	}
+	if len(dr.buf) >= len(big) {
+		t.Errorf("got a buffer of %d bytes, want less than %d", len(dr.buf), len(big))
+	}
+}
+
+func TestDumpReaderSkipBuffered(t *testing.T) {
+	doc1 := marshalDoc(t, bson.M{"login": "foo"})
+	doc2 := marshalDoc(t, bson.M{"login": "bar"})
+	doc3 := marshalDoc(t, bson.M{"login": "baz"})
+
+	dr := newDumpReader(bytes.NewReader(concat(doc1, doc2, doc3)), 0)
+	if _, err := dr.ReadDoc(); err != nil {
+		t.Fatal(err)
+	}
+	// doc2 is already buffered by the first read.
+	if err := dr.Skip(int64(len(doc2))); err != nil {
+		t.Fatal(err)
+	}
+	docs, errs := readDump(t, dr)
+	if len(errs) != 0 || !reflect.DeepEqual(docs, [][]byte{doc3}) {
+		t.Errorf("got documents %v and errors %v, want %v", docs, errs, [][]byte{doc3})
+	}
+}
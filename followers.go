@@ -0,0 +1,85 @@
+// Copyright 2014 The DevMine Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// ghFollower is a relation between a GitHub user and one of its followers.
+type ghFollower struct {
+	ID      int64  `bson:"id"`      // GitHub ID of the follower
+	Login   string `bson:"login"`   // login of the follower
+	Follows string `bson:"follows"` // login of the followed user
+}
+
+// followersFields are the fields of the gh_followers table.
+var followersFields = []string{"gh_user_id", "gh_follower_id"}
+
+// followersImporter imports BSON dumps containing GitHub followers into the
+// DevMine database.
+var followersImporter = &importer{
+	constrained: []string{"gh_followers"},
+	queries:     []string{genInsQuery("gh_followers", followersFields...)},
+	decode: func(bs []byte) (interface{}, error) {
+		ghf := ghFollower{}
+		err := bson.Unmarshal(bs, &ghf)
+		return ghf, err
+	},
+	key: func(doc interface{}) string {
+		ghf := doc.(ghFollower)
+		return ghf.Login + "\x00" + ghf.Follows
+	},
+	insert: func(txn *sql.Tx, stmts []*sql.Stmt, doc interface{}, o origin) error {
+		ghf := doc.(ghFollower)
+		printVerbose("importing follower", ghf.Login, "of", ghf.Follows)
+		return insertFollower(txn, stmts[0], ghf)
+	},
+}
+
+// followerQuery is the query of insertFollower checking whether a GitHub
+// follower already exists.
+const followerQuery = `
+	SELECT gh_followers.gh_user_id, gh_followers.gh_follower_id
+	FROM gh_followers
+	LEFT JOIN gh_users AS users ON users.id = gh_followers.gh_user_id
+	LEFT JOIN gh_users AS followers ON followers.id = gh_followers.gh_follower_id
+	WHERE users.login = $1 AND followers.login = $2`
+
+// insertFollower inserts a GitHub follower into the database.
+func insertFollower(txn *sql.Tx, stmt *sql.Stmt, ghf ghFollower) error {
+	if !*nocheck {
+		var ghUserID, ghFollowerID int64
+		err := txn.QueryRow(followerQuery, ghf.Follows, ghf.Login).Scan(&ghUserID, &ghFollowerID)
+
+		switch {
+		case err == nil:
+			printVerbose(fmt.Sprintf("the gh_followers relation (%d, %d) already exists", ghUserID, ghFollowerID))
+			return errAlreadyExists // the relation already exist, no need to create it
+		case err != sql.ErrNoRows:
+			fail(err)
+			return fmt.Errorf("impossible to fetch follower %s of %s", ghf.Login, ghf.Follows)
+		}
+	}
+
+	ghUserID := fetchGhUserIDFromLogin(txn, ghf.Follows)
+	if ghUserID <= 0 {
+		return fmt.Errorf("failed to retrieve the id of the github user having the login %s", ghf.Follows)
+	}
+
+	ghFollowerID := fetchGhUserIDFromLogin(txn, ghf.Login)
+	if ghFollowerID <= 0 {
+		return fmt.Errorf("failed to retrieve the id of the github user having the login %s", ghf.Login)
+	}
+
+	if _, err := stmt.Exec(ghUserID, ghFollowerID); err != nil {
+		fail(err)
+		return fmt.Errorf("impossible to insert follower %s of %s", ghf.Login, ghf.Follows)
+	}
+	return nil
+}
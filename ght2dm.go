@@ -7,20 +7,17 @@ package main
 import (
 	"bytes"
 	"database/sql"
-	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"regexp"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
-	"time"
 
 	"github.com/lib/pq"
 	"labix.org/v2/mgo/bson"
@@ -32,8 +29,49 @@ const (
 	ghOrgMembers        = "org_members"
 	ghRepos             = "repos"
 	ghRepoCollaborators = "repo_collaborators"
+	ghCommits           = "commits"
+	ghFollowers         = "followers"
+	ghWatchers          = "watchers"
+	ghIssues            = "issues"
+	ghIssueComments     = "issue_comments"
+	ghIssueEvents       = "issue_events"
+	ghPullRequests      = "pull_requests"
+	ghPullReqComments   = "pull_request_comments"
 )
 
+// entities lists the supported GitHub entities in the order in which they must
+// be imported: relations come after the entities they refer to.
+var entities = []string{
+	ghUsers,
+	ghOrgMembers,
+	ghFollowers,
+	ghRepos,
+	ghRepoCollaborators,
+	ghWatchers,
+	ghIssues,
+	ghIssueComments,
+	ghIssueEvents,
+	ghPullRequests,
+	ghPullReqComments,
+	ghCommits,
+}
+
+// importers maps each GitHub entity to the importer of its BSON dumps.
+var importers = map[string]*importer{
+	ghUsers:             usersImporter,
+	ghOrgMembers:        orgMembersImporter,
+	ghRepos:             reposImporter,
+	ghRepoCollaborators: repoCollaboImporter,
+	ghCommits:           commitsImporter,
+	ghFollowers:         followersImporter,
+	ghWatchers:          watchersImporter,
+	ghIssues:            issuesImporter,
+	ghIssueComments:     issueCommentsImporter,
+	ghIssueEvents:       issueEventsImporter,
+	ghPullRequests:      pullRequestsImporter,
+	ghPullReqComments:   pullRequestCommentsImporter,
+}
+
 // GHTorrent structures for unmarshalling BSON.
 type (
 	// ghUser represents a GitHub user.
@@ -90,6 +128,16 @@ type (
 		Owner struct {
 			Login string `bson:"login"`
 		} `bson:"owner"`
+
+		// Repository this repository is a fork of and root of the fork
+		// network. They are only set for forks.
+		Parent ghRepoRef `bson:"parent"`
+		Source ghRepoRef `bson:"source"`
+	}
+
+	// ghRepoRef is a reference to another GitHub repository.
+	ghRepoRef struct {
+		FullName string `bson:"full_name"`
 	}
 
 	// ghRepoCollaborator is a relation between a user and a repository.
@@ -154,6 +202,8 @@ var (
 		"created_at",
 		"updated_at",
 		"pushed_at",
+		"parent_full_name",
+		"source_full_name",
 	}
 	reposCollabosFields = []string{"user_id", "repository_id"}
 	orgMembersFields    = []string{"gh_user_id", "gh_organization_id"}
@@ -167,6 +217,15 @@ type config struct {
 	// snake case and pluralized (see defined constants).
 	GHTorrentFolder []string `json:"ghtorrent_folders"`
 
+	// GHTorrent MongoDB dump archives (mongo-dump-yyyy-mm-dd.tar.gz). They
+	// are processed after the BSON files folders, in the same order as the
+	// BSON files.
+	//
+	// The BSON collections of each archive are mapped to GitHub entities by
+	// name (eg. dump/github/users.bson contains users) and members that do not
+	// correspond to a supported entity are ignored.
+	GHTorrentArchives []string `json:"ghtorrent_archives"`
+
 	// database config
 	DevMineDatabase devmineDatabase `json:"devmine_database"`
 }
@@ -198,152 +257,88 @@ func readConfig(path string) (*config, error) {
 	return &cfg, nil
 }
 
-// dumpReader is a reader for BSON files.
-type dumpReader struct {
-	r io.Reader
-}
-
-// newDumpReader creates a new dumpReader that reads from r.
-func newDumpReader(r io.Reader) *dumpReader {
-	return &dumpReader{r: r}
-}
-
-// ReadDoc reads the next BSON document.
-func (dr *dumpReader) ReadDoc() ([]byte, error) {
-	lenBuf := make([]byte, 4)
-	if n, err := dr.r.Read(lenBuf); err != nil {
-		return nil, err
-	} else if n != 4 {
-		return nil, errors.New("malformed bson dump")
-	}
-
-	var docLen int32
-	if err := binary.Read(bytes.NewReader(lenBuf), binary.LittleEndian, &docLen); err != nil {
-		return nil, err
-	}
-
-	doc := make([]byte, docLen)
-
-	// We copy the length field into the document buffer because it is part of
-	// the document and it is expected by bson.Unmarshal.
-	copy(doc, lenBuf)
-
-	if _, err := dr.r.Read(doc[4:]); err != nil {
-		return nil, err
-	}
-
-	return doc, nil
-}
-
-// importUsers imports a BSON file containing GitHub users into the DevMine
+// usersImporter imports BSON dumps containing GitHub users into the DevMine
 // database.
-func importUsers(path string) error {
-	f, err := os.Open(path)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	r := newDumpReader(f)
-
-	// Begin a new transaction.
-	txn, err := db.Begin()
-	if err != nil {
-		return err
-	}
-	defer txn.Rollback()
-
-	// Disable foreign key constraints.
-	_, err = txn.Exec("ALTER TABLE ONLY gh_users DROP CONSTRAINT gh_users_fk_users")
-	if err != nil {
-		return err
-	}
-
-	userStmt, err := txn.Prepare(genInsQuery("users", usersFields...) + " RETURNING id")
-	if err != nil {
-		return err
-	}
-
-	ghUserStmt, err := txn.Prepare(genInsQuery("gh_users", ghUsersFields...))
-	if err != nil {
-		return err
-	}
-
-	ghOrgStmt, err := txn.Prepare(genInsQuery("gh_organizations", ghOrgsFields...))
-	if err != nil {
-		return err
-	}
-
-	for {
-		bs, err := r.ReadDoc()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			fail(err)
-			continue
-		}
-
+var usersImporter = &importer{
+	constrained: []string{"gh_users"},
+	queries: []string{
+		genInsQuery("users", usersFields...) + " RETURNING id",
+		genInsQuery("gh_users", ghUsersFields...),
+		genInsQuery("gh_organizations", ghOrgsFields...),
+
+		// update mode
+		"UPDATE users SET username=$2, name=$3, email=$4 WHERE users.id=$1",
+		genUpsertQuery("gh_users", ghUsersFields...) + " RETURNING id",
+		genUpsertQuery("gh_organizations", ghOrgsFields...),
+	},
+	decode: func(bs []byte) (interface{}, error) {
 		ghu := ghUser{}
-		if err := bson.Unmarshal(bs, &ghu); err != nil {
-			fail(path, ":", err)
-			continue
-		}
-
+		err := bson.Unmarshal(bs, &ghu)
+		return ghu, err
+	},
+	key: func(doc interface{}) string {
+		return strconv.FormatInt(doc.(ghUser).ID, 10)
+	},
+	insert: func(txn *sql.Tx, stmts []*sql.Stmt, doc interface{}, o origin) error {
+		ghu := doc.(ghUser)
 		printVerbose("importing gh_user with login", ghu.Login)
 
-		switch ghu.Type {
-		case "User":
-			userID, err := insertUser(txn, userStmt, ghu)
-			if err != nil {
-				fail(err)
-				continue
-			}
+		kind, err := validateGhUser(ghu)
+		if err != nil {
+			return err
+		}
 
-			if err := insertGhUser(txn, ghUserStmt, ghu, userID); err != nil {
-				fail(err)
-				continue
-			}
-		case "Organization":
-			if err := insertGhOrg(txn, ghOrgStmt, ghu); err != nil {
-				fail(err)
-				continue
+		switch {
+		case kind == kindUsers && *update:
+			return refreshGhUser(txn, stmts, ghu)
+		case kind == kindUsers:
+			// The user must be inserted before the GitHub user, which
+			// references it.
+			userID, err := insertUser(txn, stmts[0], ghu)
+			if err != nil {
+				return err
 			}
-		default: // should never happen
-			fail(fmt.Errorf("invalid type of user %s", ghu.Type))
-			continue
+			return insertGhUser(txn, stmts[1], ghu, userID)
+		case *update:
+			return insertGhOrg(txn, stmts[5], ghu)
+		default:
+			return insertGhOrg(txn, stmts[2], ghu)
 		}
-	}
-
-	if err := userStmt.Close(); err != nil {
-		return err
-	}
-	if err := ghUserStmt.Close(); err != nil {
-		return err
-	}
-	if err := ghOrgStmt.Close(); err != nil {
-		return err
-	}
+	},
+	validate: func(doc interface{}) (string, error) {
+		return validateGhUser(doc.(ghUser))
+	},
+}
 
-	// Re-enable foreign key constraints.
-	_, err = txn.Exec("ALTER TABLE ONLY gh_users ADD CONSTRAINT gh_users_fk_users FOREIGN KEY (user_id) REFERENCES users(id)")
-	if err != nil {
-		return err
-	}
+// Kinds of GitHub users
+const (
+	kindUsers         = "users"
+	kindOrganizations = "organizations"
+)
 
-	if err := txn.Commit(); err != nil {
-		return err
+// validateGhUser returns the kind of the GitHub user ghu, which is either a
+// user or an organization.
+func validateGhUser(ghu ghUser) (string, error) {
+	switch ghu.Type {
+	case "User":
+		return kindUsers, nil
+	case "Organization":
+		return kindOrganizations, nil
+	default: // should never happen
+		return "", fmt.Errorf("invalid type of user %s", ghu.Type)
 	}
-	return nil
 }
 
 // insertGhOrg inserts a GitHub organization into the database.
+//
+// In update mode, stmt refreshes the organization if it already exists.
 func insertGhOrg(txn *sql.Tx, stmt *sql.Stmt, ghu ghUser) error {
-	if !*nocheck {
+	if !*nocheck && !*update {
 		if id := fetchOrgID(txn, ghu.ID); id != 0 {
 			if id == -1 {
 				return errors.New("impossible to insert github organization with login = " + ghu.Login)
 			}
-			return nil
+			return errAlreadyExists
 		}
 	}
 
@@ -353,7 +348,7 @@ func insertGhOrg(txn *sql.Tx, stmt *sql.Stmt, ghu ghUser) error {
 		ghu.UpdatedAt = ghu.CreatedAt
 	}
 
-	_, err := stmt.Exec(
+	res, err := stmt.Exec(
 		ghu.Login,
 		ghu.ID,
 		ghu.AvatarURL,
@@ -368,6 +363,10 @@ func insertGhOrg(txn *sql.Tx, stmt *sql.Stmt, ghu ghUser) error {
 		fail(err)
 		return errors.New("impossible to insert github organization with login = " + ghu.Login)
 	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		// The organization in the database is at least as recent.
+		return errAlreadyExists
+	}
 	return nil
 }
 
@@ -378,7 +377,7 @@ func insertGhUser(txn *sql.Tx, stmt *sql.Stmt, ghu ghUser, userID int64) error {
 			if id == -1 {
 				return errors.New("impossible to insert github user with login = " + ghu.Login)
 			}
-			return nil
+			return errAlreadyExists
 		}
 	}
 
@@ -410,6 +409,63 @@ func insertGhUser(txn *sql.Tx, stmt *sql.Stmt, ghu ghUser, userID int64) error {
 	return nil
 }
 
+// refreshGhUser inserts a GitHub user and its user into the database or, if
+// the GitHub user already exists, refreshes both of them when ghu is more
+// recent than the GitHub user in the database.
+func refreshGhUser(txn *sql.Tx, stmts []*sql.Stmt, ghu ghUser) error {
+	userID := fetchUserID(txn, ghu.ID)
+	exists := userID != 0
+	switch {
+	case userID == -1:
+		return errors.New("impossible to refresh github user with login = " + ghu.Login)
+	case !exists:
+		var err error
+		if userID, err = insertUser(txn, stmts[0], ghu); err != nil {
+			return err
+		}
+	}
+
+	// Some documents only have a creation date, so for these ones, we set the
+	// last modification date to the creation date.
+	if ghu.UpdatedAt == "" {
+		ghu.UpdatedAt = ghu.CreatedAt
+	}
+
+	var ghUserID int64
+	err := stmts[4].QueryRow(
+		userID,
+		ghu.ID,
+		ghu.Login,
+		ghu.Bio,
+		ghu.Company,
+		ghu.Email,
+		ghu.Hireable,
+		ghu.Location,
+		ghu.AvatarURL,
+		ghu.HTMLURL,
+		ghu.Followers,
+		ghu.Following,
+		ghu.CreatedAt,
+		ghu.UpdatedAt).Scan(&ghUserID)
+	switch {
+	case err == sql.ErrNoRows:
+		// The GitHub user in the database is at least as recent.
+		return errAlreadyExists
+	case err != nil:
+		fail(err)
+		return errors.New("impossible to refresh github user with login = " + ghu.Login)
+	}
+
+	if !exists {
+		return nil
+	}
+	if _, err := stmts[3].Exec(userID, ghu.Login, ghu.Name, ghu.Email); err != nil {
+		fail(err)
+		return errors.New("impossible to refresh user with login " + ghu.Login)
+	}
+	return nil
+}
+
 // insertUser inserts a user into the database.
 func insertUser(txn *sql.Tx, stmt *sql.Stmt, ghu ghUser) (int64, error) {
 	if !*nocheck {
@@ -417,7 +473,7 @@ func insertUser(txn *sql.Tx, stmt *sql.Stmt, ghu ghUser) (int64, error) {
 			if id == -1 {
 				return 0, errors.New("impossible to insert user with login " + ghu.Login)
 			}
-			return 0, nil
+			return 0, errAlreadyExists
 		}
 	}
 
@@ -430,6 +486,9 @@ func insertUser(txn *sql.Tx, stmt *sql.Stmt, ghu ghUser) (int64, error) {
 	return userID, nil
 }
 
+// fetchUserIDQuery is the query of fetchUserID.
+const fetchUserIDQuery = "SELECT gh_users.user_id FROM gh_users WHERE gh_users.github_id=$1"
+
 // fetchUserID fetches the user ID corresponding to a given GitHub user ID.
 //
 // It returns 0 if the user does not already exists in the database and -1 if
@@ -439,7 +498,7 @@ func insertUser(txn *sql.Tx, stmt *sql.Stmt, ghu ghUser) (int64, error) {
 // returning -1.
 func fetchUserID(txn *sql.Tx, githubID int64) int64 {
 	var id int64
-	err := txn.QueryRow("SELECT user_id FROM gh_users WHERE github_id=$1", githubID).Scan(&id)
+	err := txn.QueryRow(fetchUserIDQuery, githubID).Scan(&id)
 
 	switch {
 	case err == sql.ErrNoRows:
@@ -452,13 +511,16 @@ func fetchUserID(txn *sql.Tx, githubID int64) int64 {
 	return id
 }
 
+// fetchGhUserIDQuery is the query of fetchGhUserID.
+const fetchGhUserIDQuery = "SELECT gh_users.id FROM gh_users WHERE gh_users.github_id=$1"
+
 // fetchGhUserID fetches the GitHub user ID corresponding to a given GitHub user
 // ID.
 // It returns 0 if the GitHub user does not already exists in the database and
 // -1 if an error occured while processing the query.
 func fetchGhUserID(txn *sql.Tx, githubID int64) int64 {
 	var id int64
-	err := txn.QueryRow("SELECT id FROM gh_users WHERE github_id=$1", githubID).Scan(&id)
+	err := txn.QueryRow(fetchGhUserIDQuery, githubID).Scan(&id)
 	switch {
 	case err == sql.ErrNoRows:
 		return 0
@@ -470,13 +532,16 @@ func fetchGhUserID(txn *sql.Tx, githubID int64) int64 {
 	return id
 }
 
+// fetchOrgIDQuery is the query of fetchOrgID.
+const fetchOrgIDQuery = "SELECT gh_organizations.id FROM gh_organizations WHERE gh_organizations.github_id=$1"
+
 // fetchOrgID fetches the organizationID corresponding to a given GitHub user
 // ID.
 // It returns 0 if the organization does not already exists in the database and
 // -1 if an error occured while processing the query.
 func fetchOrgID(txn *sql.Tx, githubID int64) int64 {
 	var id int64
-	err := txn.QueryRow("SELECT id FROM gh_organizations WHERE github_id=$1", githubID).Scan(&id)
+	err := txn.QueryRow(fetchOrgIDQuery, githubID).Scan(&id)
 
 	switch {
 	case err == sql.ErrNoRows:
@@ -489,62 +554,35 @@ func fetchOrgID(txn *sql.Tx, githubID int64) int64 {
 	return id
 }
 
-// importRepos imports a BSON file containing GitHub repositories into the
+// reposImporter imports BSON dumps containing GitHub repositories into the
 // DevMine database.
-func importRepos(path string) error {
-	f, err := os.Open(path)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	r := newDumpReader(f)
-
-	// Begin a new transaction.
-	txn, err := db.Begin()
-	if err != nil {
-		return err
-	}
-	defer txn.Rollback()
-
-	tmpRepoStmt, err := txn.Prepare(pq.CopyIn("tmp_gh_repositories", tmpReposFields...))
-	if err != nil {
-		return err
-	}
-
-	for {
-		bs, err := r.ReadDoc()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			fail(err)
-			continue
-		}
-
+//
+// Repositories are inserted into the tmp_gh_repositories table and merged into
+// the repositories and gh_repositories tables by insert_repos() (see staging).
+var reposImporter = &importer{
+	queries: []string{pq.CopyIn("tmp_gh_repositories", tmpReposFields...)},
+	copyIn:  true,
+	decode: func(bs []byte) (interface{}, error) {
 		ghr := ghRepo{}
-		if err := bson.Unmarshal(bs, &ghr); err != nil {
-			fail(err)
-			continue
-		}
-
+		err := bson.Unmarshal(bs, &ghr)
+		return ghr, err
+	},
+	insert: func(txn *sql.Tx, stmts []*sql.Stmt, doc interface{}, o origin) error {
+		ghr := doc.(ghRepo)
 		printVerbose("importing gh_repo with clone url", ghr.HTMLURL+".git")
-
-		if err := insertTmpRepo(txn, tmpRepoStmt, ghr); err != nil {
-			fail(err)
-			continue
+		return insertTmpRepo(txn, stmts[0], ghr)
+	},
+	validate: func(doc interface{}) (string, error) {
+		ghr := doc.(ghRepo)
+		switch {
+		case ghr.Language == "" || ghr.CloneURL == "":
+			// insert_repos() ignores them
+			return "ignored repositories", nil
+		case ghr.Fork:
+			return "forks", nil
 		}
-	}
-
-	if _, err := tmpRepoStmt.Exec(); err != nil {
-		return err
-	}
-	if err := tmpRepoStmt.Close(); err != nil {
-		return err
-	}
-	if err := txn.Commit(); err != nil {
-		return err
-	}
-	return nil
+		return "repositories", nil
+	},
 }
 
 // buildClonePath build the clone path for a repository.
@@ -574,6 +612,18 @@ func removeNullByte(s string) string {
 	return string(bytes.Replace([]byte(s), []byte{0x0}, []byte{}, -1))
 }
 
+// nullIfEmpty returns nil if s is empty and s, without null bytes, otherwise.
+//
+// It must be used for optional columns, such as dates, for which PostgreSQL
+// does not accept empty strings.
+func nullIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	s = removeNullByte(s)
+	return &s
+}
+
 // insertTmpRepo inserts a repository into a temporary table in the database.
 func insertTmpRepo(txn *sql.Tx, stmt *sql.Stmt, ghr ghRepo) error {
 	clonePath := buildClonePath(ghr)
@@ -614,7 +664,9 @@ func insertTmpRepo(txn *sql.Tx, stmt *sql.Stmt, ghr ghRepo) error {
 		ghr.WatchersCount,
 		createdAt,
 		updatedAt,
-		pushedAt)
+		pushedAt,
+		nullIfEmpty(ghr.Parent.FullName),
+		nullIfEmpty(ghr.Source.FullName))
 	if err != nil {
 		fail(err)
 		return fmt.Errorf("impossible to insert tmp repository with github_id %d", ghr.ID)
@@ -622,6 +674,15 @@ func insertTmpRepo(txn *sql.Tx, stmt *sql.Stmt, ghr ghRepo) error {
 	return nil
 }
 
+// fetchRepoIDQuery is the query of fetchRepoID.
+const fetchRepoIDQuery = `
+	SELECT repositories.id
+	FROM gh_repositories
+	LEFT JOIN repositories ON repositories.id = gh_repositories.repository_id
+	WHERE gh_repositories.github_id=$1
+	OR repositories.clone_url=$2
+	OR repositories.clone_path=$3`
+
 // fetchRepoID fetches the repository ID corresponding to a given GitHub
 // repository ID.
 //
@@ -633,13 +694,7 @@ func insertTmpRepo(txn *sql.Tx, stmt *sql.Stmt, ghr ghRepo) error {
 func fetchRepoID(txn *sql.Tx, ghr ghRepo) int64 {
 	clonePath := buildClonePath(ghr)
 	var id int64
-	err := txn.QueryRow(`
-		SELECT repositories.id
-		FROM gh_repositories
-		LEFT JOIN repositories ON repositories.id = gh_repositories.repository_id
-		WHERE gh_repositories.github_id=$1
-		OR repositories.clone_url=$2
-		OR repositories.clone_path=$3`, ghr.ID, ghr.CloneURL, clonePath).Scan(&id)
+	err := txn.QueryRow(fetchRepoIDQuery, ghr.ID, ghr.CloneURL, clonePath).Scan(&id)
 
 	switch {
 	case err == sql.ErrNoRows:
@@ -652,92 +707,41 @@ func fetchRepoID(txn *sql.Tx, ghr ghRepo) int64 {
 	return id
 }
 
-// importOrgMembers imports a BSon file containing GitHub organization members
-// into the DevMine database.
-func importOrgMembers(path string) error {
-	f, err := os.Open(path)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	r := newDumpReader(f)
-
-	// Begin a new transaction.
-	txn, err := db.Begin()
-	if err != nil {
-		return err
-	}
-	defer txn.Rollback()
-
-	// Disable foreign key constraints.
-	_, err = txn.Exec("ALTER TABLE ONLY gh_users_organizations DROP CONSTRAINT gh_users_organizations_fk_organization")
-	if err != nil {
-		return err
-	}
-	_, err = txn.Exec("ALTER TABLE ONLY gh_users_organizations DROP CONSTRAINT gh_users_organizations_fk_users")
-	if err != nil {
-		return err
-	}
-
-	orgMemberStmt, err := txn.Prepare(genInsQuery("gh_users_organizations", orgMembersFields...))
-	if err != nil {
-		return err
-	}
-
-	for {
-		bs, err := r.ReadDoc()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			fail(err)
-			continue
-		}
-
+// orgMembersImporter imports BSON dumps containing GitHub organization
+// members into the DevMine database.
+var orgMembersImporter = &importer{
+	constrained: []string{"gh_users_organizations"},
+	queries:     []string{genInsQuery("gh_users_organizations", orgMembersFields...)},
+	decode: func(bs []byte) (interface{}, error) {
 		ghom := ghOrgMember{}
-		if err := bson.Unmarshal(bs, &ghom); err != nil {
-			fail(err)
-			continue
-		}
-
-		if err := insertOrgMember(txn, orgMemberStmt, ghom); err != nil {
-			fail(err)
-			continue
-		}
-	}
-
-	if err := orgMemberStmt.Close(); err != nil {
-		return err
-	}
-
-	// Re-enable foreign key constraints.
-	_, err = txn.Exec("ALTER TABLE ONLY gh_users_organizations ADD CONSTRAINT gh_users_organizations_fk_organization FOREIGN KEY (gh_organization_id) REFERENCES gh_organizations(id)")
-	if err != nil {
-		return err
-	}
-	_, err = txn.Exec("ALTER TABLE ONLY gh_users_organizations ADD CONSTRAINT gh_users_organizations_fk_users FOREIGN KEY (gh_user_id) REFERENCES gh_users(id)")
-	if err != nil {
-		return err
-	}
-
-	if err := txn.Commit(); err != nil {
-		return err
-	}
-
-	return nil
+		err := bson.Unmarshal(bs, &ghom)
+		return ghom, err
+	},
+	key: func(doc interface{}) string {
+		ghom := doc.(ghOrgMember)
+		return ghom.Login + "\x00" + ghom.Org
+	},
+	insert: func(txn *sql.Tx, stmts []*sql.Stmt, doc interface{}, o origin) error {
+		return insertOrgMember(txn, stmts[0], doc.(ghOrgMember))
+	},
 }
 
+// orgMemberQuery is the query of insertOrgMember checking whether a GitHub
+// organization member already exists.
+const orgMemberQuery = `
+	SELECT gh_users_organizations.gh_user_id, gh_users_organizations.gh_organization_id
+	FROM gh_users_organizations
+	LEFT JOIN gh_users ON gh_users.id = gh_users_organizations.gh_user_id
+	LEFT JOIN gh_organizations ON gh_organizations.id = gh_users_organizations.gh_organization_id
+	WHERE gh_users.login = $1 AND gh_organizations.login = $2`
+
 // insertOrgMember inserts a GitHub organization member into the database.
 func insertOrgMember(txn *sql.Tx, stmt *sql.Stmt, ghom ghOrgMember) error {
 	if !*nocheck {
-		rows, err := txn.Query(`
-		SELECT gh_users_organizations.gh_user_id, gh_users_organizations.gh_organization_id
-		FROM gh_users_organizations
-		LEFT JOIN gh_users ON gh_users.id = gh_users_organizations.gh_user_id
-		LEFT JOIN gh_organizations ON gh_organizations.id = gh_users_organizations.gh_organization_id
-		WHERE gh_users.login = $1 AND gh_organizations.login = $2
-	`, ghom.Login, ghom.Org)
-		defer rows.Close()
+		rows, err := txn.Query(orgMemberQuery, ghom.Login, ghom.Org)
+		if rows != nil {
+			defer rows.Close()
+		}
 
 		switch {
 		case rows != nil && rows.Next():
@@ -745,7 +749,7 @@ func insertOrgMember(txn *sql.Tx, stmt *sql.Stmt, ghom ghOrgMember) error {
 			if err := rows.Scan(&ghUserID, &ghOrgID); err == nil {
 				printVerbose(fmt.Sprintf("the gh_users_organizations relation (%d, %d) already exists", ghUserID, ghOrgID))
 			}
-			return nil // the relation already exist, no need to create it
+			return errAlreadyExists // the relation already exist, no need to create it
 		case err != nil:
 			fail(err)
 			return fmt.Errorf("impossible to fetch member organization with id %d", ghom.ID)
@@ -771,13 +775,16 @@ func insertOrgMember(txn *sql.Tx, stmt *sql.Stmt, ghom ghOrgMember) error {
 	return nil
 }
 
+// fetchGhUserIDFromLoginQuery is the query of fetchGhUserIDFromLogin.
+const fetchGhUserIDFromLoginQuery = "SELECT gh_users.id FROM gh_users WHERE gh_users.login=$1"
+
 // fetchGhUserIDFromLogin fetches the GitHub user ID corresponding to a given
 // login.
 // It returns 0 if the GitHub user does not already exists in the database and
 // -1 if an error occured while processing the query.
 func fetchGhUserIDFromLogin(txn *sql.Tx, login string) int64 {
 	var id int64
-	err := txn.QueryRow("SELECT id FROM gh_users WHERE login=$1", login).Scan(&id)
+	err := txn.QueryRow(fetchGhUserIDFromLoginQuery, login).Scan(&id)
 
 	switch {
 	case err == sql.ErrNoRows:
@@ -790,13 +797,16 @@ func fetchGhUserIDFromLogin(txn *sql.Tx, login string) int64 {
 	return id
 }
 
+// fetchGhOrgIDFromLoginQuery is the query of fetchGhOrgIDFromLogin.
+const fetchGhOrgIDFromLoginQuery = "SELECT gh_organizations.id FROM gh_organizations WHERE gh_organizations.login=$1"
+
 // fetchGhOrgIDFromLogin fetches the GitHub organization ID corresponding to a
 // given login.
 // It returns 0 if the GitHub organization does not already exists in the
 // database and -1 if an error occured while processing the query.
 func fetchGhOrgIDFromLogin(txn *sql.Tx, login string) int64 {
 	var id int64
-	err := txn.QueryRow("SELECT id FROM gh_organizations WHERE login=$1", login).Scan(&id)
+	err := txn.QueryRow(fetchGhOrgIDFromLoginQuery, login).Scan(&id)
 
 	switch {
 	case err == sql.ErrNoRows:
@@ -809,95 +819,42 @@ func fetchGhOrgIDFromLogin(txn *sql.Tx, login string) int64 {
 	return id
 }
 
-// importRepoCollabo imports a BSON file containing GitHub repository
+// repoCollaboImporter imports BSON dumps containing GitHub repository
 // collaborators into the DevMine database.
-func importRepoCollabo(path string) error {
-	f, err := os.Open(path)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	r := newDumpReader(f)
-
-	// Begin a new transaction.
-	txn, err := db.Begin()
-	if err != nil {
-		return err
-	}
-	defer txn.Rollback()
-
-	// Disable foreign key constraints.
-	/*_, err = txn.Exec("ALTER TABLE ONLY users_repositories DROP CONSTRAINT users_repositories_fk_repository")
-	if err != nil {
-		return err
-	}
-	_, err = txn.Exec("ALTER TABLE ONLY users_repositories DROP CONSTRAINT users_repositories_fk_users")
-	if err != nil {
-		return err
-	}*/
-
-	repoCollaboStmt, err := txn.Prepare(genInsQuery("users_repositories", reposCollabosFields...))
-	if err != nil {
-		return err
-	}
-
-	for {
-		bs, err := r.ReadDoc()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			fail(err)
-			continue
-		}
-
+var repoCollaboImporter = &importer{
+	constrained: []string{"users_repositories"},
+	queries:     []string{genInsQuery("users_repositories", reposCollabosFields...)},
+	decode: func(bs []byte) (interface{}, error) {
 		ghrc := ghRepoCollaborator{}
-		if err := bson.Unmarshal(bs, &ghrc); err != nil {
-			fail(err)
-			continue
-		}
-
+		err := bson.Unmarshal(bs, &ghrc)
+		return ghrc, err
+	},
+	key: func(doc interface{}) string {
+		ghrc := doc.(ghRepoCollaborator)
+		return ghrc.Login + "\x00" + ghrc.Owner + "/" + ghrc.Repo
+	},
+	insert: func(txn *sql.Tx, stmts []*sql.Stmt, doc interface{}, o origin) error {
+		ghrc := doc.(ghRepoCollaborator)
 		printVerbose("importing repo_collaborators with login", ghrc.Login, ", owner", ghrc.Owner, "and repo", ghrc.Repo)
-
-		if err := insertRepoCollabo(txn, repoCollaboStmt, ghrc); err != nil {
-			fail(err)
-			continue
-		}
-	}
-
-	if err := repoCollaboStmt.Close(); err != nil {
-		return err
-	}
-
-	// Re-enable foreign key constraints.
-	_, err = txn.Exec("ALTER TABLE ONLY users_repositories ADD CONSTRAINT users_repositories_fk_repository FOREIGN KEY (repository_id) REFERENCES repositories(id)")
-	if err != nil {
-		return err
-	}
-	_, err = txn.Exec("ALTER TABLE ONLY users_repositories ADD CONSTRAINT users_repositories_fk_users FOREIGN KEY (user_id) REFERENCES users(id)")
-	if err != nil {
-		return err
-	}
-
-	if err := txn.Commit(); err != nil {
-		return err
-	}
-
-	return nil
+		return insertRepoCollabo(txn, stmts[0], ghrc)
+	},
 }
 
+// repoCollaboQuery is the query of insertRepoCollabo checking whether a GitHub
+// repository collaborator already exists.
+const repoCollaboQuery = `
+	SELECT users_repositories.user_id, users_repositories.repository_id
+	FROM users_repositories
+	LEFT JOIN users ON users.id = users_repositories.user_id
+	LEFT JOIN gh_users ON gh_users.user_id = users.id
+	LEFT JOIN repositories ON repositories.id = users_repositories.repository_id
+	LEFT JOIN gh_repositories ON gh_repositories.id = repositories.id
+	WHERE gh_users.login = $1 AND gh_repositories.full_name = $2`
+
 // insertRepoCollabo inserts a GitHub repository collaborator into the database.
 func insertRepoCollabo(txn *sql.Tx, stmt *sql.Stmt, ghrc ghRepoCollaborator) error {
 	if !*nocheck {
-		rows, err := txn.Query(`
-			SELECT users_repositories.user_id, users_repositories.repository_id
-			FROM users_repositories
-			LEFT JOIN users ON users.id = users_repositories.user_id
-			LEFT JOIN gh_users ON gh_users.user_id = users.id
-			LEFT JOIN repositories ON repositories.id = users_repositories.repository_id
-			LEFT JOIN gh_repositories ON gh_repositories.id = repositories.id
-			WHERE gh_users.login = $1 AND gh_repositories.full_name = $2
-		`, ghrc.Login, ghrc.Owner+"/"+ghrc.Repo)
+		rows, err := txn.Query(repoCollaboQuery, ghrc.Login, ghrc.Owner+"/"+ghrc.Repo)
 		if rows != nil {
 			defer rows.Close()
 		}
@@ -908,7 +865,7 @@ func insertRepoCollabo(txn *sql.Tx, stmt *sql.Stmt, ghrc ghRepoCollaborator) err
 			if err := rows.Scan(&userID, &repoID); err == nil {
 				printVerbose(fmt.Sprintf("the users_repositories relation (%d, %d) already exists", userID, repoID))
 			}
-			return nil // the relation already exist, no need to create it
+			return errAlreadyExists // the relation already exist, no need to create it
 		case err != nil:
 			fail(err)
 			return fmt.Errorf("impossible to fetch repo collaborator with id %d", ghrc.ID)
@@ -934,18 +891,20 @@ func insertRepoCollabo(txn *sql.Tx, stmt *sql.Stmt, ghrc ghRepoCollaborator) err
 	return nil
 }
 
+// fetchRepoIDFromFullnameQuery is the query of fetchRepoIDFromFullname.
+const fetchRepoIDFromFullnameQuery = `
+	SELECT repositories.id AS repo_id
+	FROM repositories
+	LEFT JOIN gh_repositories ON gh_repositories.repository_id = repositories.id
+	WHERE gh_repositories.full_name=$1`
+
 // fetchRepoIDFromFullname fetches the repository ID corresponding to a
 // given GitHub repository fullname.
 // It returns 0 if the repository does not already exists in the
 // database and -1 if an error occured while processing the query.
 func fetchRepoIDFromFullname(txn *sql.Tx, fullname string) int64 {
 	var id int64
-	err := txn.QueryRow(`
-		SELECT repositories.id AS repo_id
-		FROM repositories
-		LEFT JOIN gh_repositories ON gh_repositories.repository_id = repositories.id
-		WHERE gh_repositories.full_name=$1
-	`, fullname).Scan(&id)
+	err := txn.QueryRow(fetchRepoIDFromFullnameQuery, fullname).Scan(&id)
 
 	switch {
 	case err == sql.ErrNoRows:
@@ -958,6 +917,10 @@ func fetchRepoIDFromFullname(txn *sql.Tx, fullname string) int64 {
 	return id
 }
 
+// errAlreadyExists is returned by the insert functions when the document is
+// already in the database, in which case it is skipped.
+var errAlreadyExists = errors.New("already in the database")
+
 // genInsQuery generates a query string for an insertion into the database.
 func genInsQuery(tableName string, fields ...string) string {
 	var buf bytes.Buffer
@@ -978,10 +941,46 @@ func genInsQuery(tableName string, fields ...string) string {
 	return buf.String()
 }
 
+// genUpsertQuery generates a query string for an insertion into the database
+// that, when a row with the same GitHub ID already exists, updates it instead
+// if the inserted row is more recent. Rows without any last modification date
+// never replace an existing row. The user_id field is never updated.
+func genUpsertQuery(tableName string, fields ...string) string {
+	var buf bytes.Buffer
+
+	buf.WriteString(genInsQuery(tableName, fields...))
+	buf.WriteString("ON CONFLICT (github_id) DO UPDATE SET ")
+
+	var n int
+	for _, field := range fields {
+		if field == "github_id" || field == "user_id" {
+			continue
+		}
+		if n > 0 {
+			buf.WriteString(",")
+		}
+		buf.WriteString(fmt.Sprintf("%s=EXCLUDED.%s", field, field))
+		n++
+	}
+
+	buf.WriteString(fmt.Sprintf("\nWHERE EXCLUDED.updated_at IS NOT NULL AND (%s.updated_at IS NULL OR %s.updated_at < EXCLUDED.updated_at)\n", tableName, tableName))
+
+	return buf.String()
+}
+
+// importerFor returns the importer of the BSON dumps of the given entity,
+// which depends on whether bulk imports are enabled.
+func importerFor(entity string) *importer {
+	if imp, ok := bulkImporters[entity]; ok && *bulk {
+		return imp
+	}
+	return importers[entity]
+}
+
 // A fileInfoList is just a wrapper around a slice of os.FileInfo that
 // implements the sort.Interface. In other words, it is a sortable list of
 // os.FileInfo. They are sorted by the date (the one present in the file name)
-// in descending order.
+// in the order given on the command line (see dumpBefore).
 type fileInfoList []os.FileInfo
 
 func (fil fileInfoList) Len() int {
@@ -993,71 +992,106 @@ func (fil fileInfoList) Swap(i, j int) {
 }
 
 func (fil fileInfoList) Less(i, j int) bool {
-	di, err := time.Parse("2006-01-02", strings.TrimSuffix(fil[i].Name(), ".bson"))
+	di, err := dumpDate(fil[i].Name())
 	if err != nil {
 		// this should never happen since file must have a correct name
 		fail(err)
 		return false
 	}
 
-	dj, err := time.Parse("2006-01-02", strings.TrimSuffix(fil[j].Name(), ".bson"))
+	dj, err := dumpDate(fil[j].Name())
 	if err != nil {
 		// this should never happen since file must have a correct name
 		fail(err)
 		return false
 	}
 
-	return di.After(dj)
+	return dumpBefore(di, dj)
 }
 
-func visit(path, entity string) error {
+// visit schedules the import of the BSON dumps contained in the folder at
+// path, which contains documents of the given GitHub entity, in the order
+// given on the command line. Dumps outside of the range of dates given on the
+// command line are skipped.
+func visit(s *scheduler, path, entity string) error {
+	if _, ok := importers[entity]; !ok {
+		return fmt.Errorf("unsupported github entity %s", entity)
+	}
+
 	fis, err := ioutil.ReadDir(path)
 	if err != nil {
 		return err
 	}
 
-	fil := fileInfoList(fis)
+	var fil fileInfoList
+	for _, fi := range fis {
+		if !isDumpName(fi.Name()) {
+			fmt.Printf("[%s] skipped '%s'\n", entity, fi.Name())
+			continue
+		}
+		if date, _ := dumpDate(fi.Name()); !inDateRange(date) {
+			fmt.Printf("[%s] skipped '%s': out of date range\n", entity, fi.Name())
+			continue
+		}
+		fil = append(fil, fi)
+	}
 	sort.Sort(fil)
 
 	for _, fi := range fil {
-		if ok, err := regexp.MatchString("[0-9]{4}-[0-9]{2}-[0-9]{2}\\.bson", fi.Name()); !ok {
-			if err != nil {
-				fail(err)
+		fullpath := filepath.Join(path, fi.Name())
+		s.add(entity, func() {
+			if err := importDumpFile(entity, fullpath); err != nil {
+				fail(fmt.Sprintf("failed to import bson '%s': %v", fullpath, err))
+				importFailed(err)
 			}
-			fmt.Printf("[%s] skipped '%s'\n", entity, fi.Name())
-			continue
-		}
+		})
+	}
 
-		fmt.Printf("[%s] processing '%s'\n", entity, fi.Name())
+	return nil
+}
 
-		fullpath := filepath.Join(path, fi.Name())
-		var err error
+// importDumpFile imports the BSON dump file at path, which contains documents
+// of the given GitHub entity, unless it has already been imported. In dry-run
+// mode, the dump is only read.
+func importDumpFile(entity, path string) error {
+	if *dryRun {
+		return dryRunDumpFile(entity, path)
+	}
 
-		switch entity {
-		case ghUsers:
-			if err = importUsers(fullpath); err != nil {
-				break
-			}
-		case ghOrgMembers:
-			err = importOrgMembers(fullpath)
-		case ghRepos:
-			if err = importRepos(fullpath); err != nil {
-				break
-			}
-		case ghRepoCollaborators:
-			err = importRepoCollabo(fullpath)
-		}
+	date, err := dumpDate(filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	checksum, err := fileChecksum(path)
+	if err != nil {
+		return err
+	}
+	cp, err := loadCheckpoint(entity, date, checksum)
+	if err != nil {
+		return err
+	}
+	rep := report.startDump(entity, path)
+	if cp.Completed {
+		fmt.Printf("[%s] skipped '%s': already imported\n", entity, filepath.Base(path))
+		rep.skip()
+		return nil
+	}
 
-		if err != nil {
-			fail(fmt.Sprintf("failed to import bson '%s': %v",
-				filepath.Join(path, fi.Name()), err))
-		}
+	fmt.Printf("[%s] processing '%s'\n", entity, filepath.Base(path))
+
+	f, err := openDump(path)
+	if err != nil {
+		rep.finish(err)
+		return err
 	}
+	defer f.Close()
 
-	return nil
+	err = importerFor(entity).importDump(f, cp, rep)
+	rep.finish(err)
+	return err
 }
 
-// fatal log an error into stderr and exit with status 1.
+// fatal log an error into stderr and exit with status exitFatal.
 func fatal(a ...interface{}) {
 	// XXX: avoid code duplication
 	var msg string
@@ -1073,7 +1107,7 @@ func fatal(a ...interface{}) {
 	}
 	msg += fmt.Sprint(a...)
 	fmt.Fprintln(os.Stderr, msg)
-	os.Exit(1)
+	os.Exit(exitFatal)
 }
 
 // fail log an error without exiting.
@@ -1121,38 +1155,147 @@ func setupDB(cfg devmineDatabase) error {
 
 // Command line options.
 var (
-	vflag   = flag.Bool("v", false, "enable verbose mode")
-	dflag   = flag.Bool("d", false, "enable debug mode")
-	nocheck = flag.Bool("nocheck", false, "do not check if an entry is already present in the database (only use when there is no duplicate)")
+	vflag           = flag.Bool("v", false, "enable verbose mode")
+	dflag           = flag.Bool("d", false, "enable debug mode")
+	nocheck         = flag.Bool("nocheck", false, "do not check if an entry is already present in the database (only use when there is no duplicate)")
+	maxDocSize      = flag.Int("maxdocsize", defaultMaxDocSize, "maximum size in bytes of a BSON document, bigger documents are considered malformed")
+	nbDecoders      = flag.Int("decoders", runtime.NumCPU(), "number of goroutines decoding BSON documents")
+	nbWriters       = flag.Int("writers", 1, "number of goroutines writing into the database, each with its own connection and transaction")
+	batchSize       = flag.Int("batchsize", 0, "commit the import of dumps every this number of documents, along with a checkpoint (0 to commit each dump at once)")
+	alterFKs        = flag.Bool("alterconstraints", false, "make the foreign key constraints that are not deferrable deferrable while a dump is imported by a single writer, which locks their tables until the dump is committed")
+	jobs            = flag.Int("jobs", 1, "maximum number of BSON dumps imported concurrently")
+	bulk            = flag.Bool("bulk", false, "import documents into staging tables using COPY and merge them using set-based queries")
+	stagingKind     = flag.String("staging", stagingTable, "kind of the staging tables of repositories and commits: table, unlogged or temp")
+	order           = flag.String("order", orderDesc, "order in which dated dumps and archives are imported: desc (newest first) or asc (oldest first)")
+	since           = flag.String("since", "", "only import dumps and archives dated on or after this date (yyyy-mm-dd)")
+	until           = flag.String("until", "", "only import dumps and archives dated on or before this date (yyyy-mm-dd)")
+	update          = flag.Bool("update", false, "refresh users, organizations and repositories already in the database with the attributes of more recent snapshots")
+	dryRun          = flag.Bool("dry-run", false, "read, decode and validate the dumps without accessing the database, and print the number of documents of each entity")
+	reportPath      = flag.String("report", "", "write a JSON report of the run, with the number of documents read, inserted, skipped and failed per entity and per dump, to this file")
+	deadLetterPath  = flag.String("deadletter", "", "append the documents rejected by the import, with their source and the reason, to this JSON lines file")
+	maxDumpFailures = flag.String("maxfailures", "", "error budget of each dump: maximum count (eg. 100) or percentage (eg. 5%) of failed documents, optionally per entity (eg. users=100,repos=1%), beyond which the dump is rolled back and the run aborted; by default, a dump fails when all its documents failed")
+	maxRunFailures  = flag.String("maxrunfailures", "", "error budget of the run, per entity, with the same syntax as -maxfailures")
+	keepStaging     = flag.Bool("keepstaging", false, "keep the content of the staging tables of repositories and commits after merging them, for debugging")
+	spoolDir        = flag.String("spooldir", "", "directory where the collections of archives are spooled until their entity is imported (default: the temporary directory)")
 )
 
 func main() {
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "usage: %s [config]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "usage: %s [config]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s migrate up|down|status [config]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s replay [deadletter] [config]\n\n", os.Args[0])
 		fmt.Fprintln(os.Stderr, "Available options:")
 		flag.PrintDefaults()
-		os.Exit(1)
+		os.Exit(exitFatal)
 	}
 	flag.Parse()
 
-	if flag.NArg() != 1 {
+	args := flag.Args()
+	var migrateCmd, replayPath string
+	if len(args) > 0 && (args[0] == "migrate" || args[0] == "replay") {
+		if len(args) != 3 {
+			fmt.Fprintln(os.Stderr, "invalid # of arguments")
+			flag.Usage()
+		}
+		if args[0] == "migrate" {
+			migrateCmd = args[1]
+		} else {
+			replayPath = args[1]
+		}
+		args = args[2:]
+	}
+
+	if len(args) != 1 {
 		fmt.Fprintln(os.Stderr, "invalid # of arguments")
 		flag.Usage()
 	}
 
-	cfg, err := readConfig(flag.Arg(0))
+	cfg, err := readConfig(args[0])
 	if err != nil {
 		fatal(err)
 	}
 
+	if err := checkDumpOrder(); err != nil {
+		fatal(err)
+	}
+	if err := checkErrorBudgets(); err != nil {
+		fatal(err)
+	}
+
+	if *dryRun {
+		if migrateCmd != "" || replayPath != "" {
+			fatal("migrate and replay cannot be run in dry-run mode")
+		}
+		s := newScheduler(*jobs)
+		if err := visitAll(s, cfg); err != nil {
+			fatal(err)
+		}
+		s.run()
+		removeSpools()
+		printDryRunCounts()
+		os.Exit(exitCode())
+	}
+
 	if err := setupDB(cfg.DevMineDatabase); err != nil {
 		fatal(err)
 	}
 	defer db.Close()
 
-	for _, f := range cfg.GHTorrentFolder {
-		if err := visit(f, filepath.Base(f)); err != nil {
+	if migrateCmd != "" {
+		if err := migrate(migrateCmd); err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	if err := checkSchemaVersion(); err != nil {
+		fatal(err)
+	}
+	if err := checkSchema(); err != nil {
+		fatal(err)
+	}
+
+	if err := checkStagingKind(); err != nil {
+		fatal(err)
+	}
+
+	s := newScheduler(*jobs)
+	if replayPath != "" {
+		err = scheduleReplay(s, replayPath)
+	} else {
+		err = visitAll(s, cfg)
+	}
+	if err != nil {
+		fatal(err)
+	}
+	if err := setupStagings(s); err != nil {
+		fatal(err)
+	}
+	s.run()
+	removeSpools()
+
+	if err := closeDeadLetters(); err != nil {
+		fatal(err)
+	}
+	if *reportPath != "" {
+		if err := report.write(*reportPath); err != nil {
 			fatal(err)
 		}
 	}
+
+	if aborted() {
+		fail("run aborted: error budget exceeded")
+	}
+	os.Exit(exitCode())
+}
+
+// visitAll schedules the import of the BSON dumps contained in the folders
+// and the archives of the configuration.
+func visitAll(s *scheduler, cfg *config) error {
+	for _, f := range cfg.GHTorrentFolder {
+		if err := visit(s, f, filepath.Base(f)); err != nil {
+			return err
+		}
+	}
+	return visitArchives(s, cfg.GHTorrentArchives)
 }
@@ -0,0 +1,353 @@
+// Copyright 2014 The DevMine Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+
+	"labix.org/v2/mgo/bson"
+)
+
+type (
+	// ghIssue represents an issue of a GitHub repository.
+	ghIssue struct {
+		ID        int64  `bson:"id"`
+		Number    int64  `bson:"number"`
+		Title     string `bson:"title"`
+		Body      string `bson:"body"`
+		State     string `bson:"state"` // open or closed
+		Comments  int64  `bson:"comments"`
+		CreatedAt string `bson:"created_at"`
+		UpdatedAt string `bson:"updated_at"`
+		ClosedAt  string `bson:"closed_at"`
+
+		// Repository of the issue
+		Owner string `bson:"owner"`
+		Repo  string `bson:"repo"`
+
+		// Author of the issue
+		User struct {
+			Login string `bson:"login"`
+		} `bson:"user"`
+
+		// User the issue is assigned to, if any
+		Assignee struct {
+			Login string `bson:"login"`
+		} `bson:"assignee"`
+	}
+
+	// ghIssueComment represents a comment on a GitHub issue.
+	ghIssueComment struct {
+		ID        int64  `bson:"id"`
+		IssueID   int64  `bson:"issue_id"` // number of the issue
+		Body      string `bson:"body"`
+		CreatedAt string `bson:"created_at"`
+		UpdatedAt string `bson:"updated_at"`
+
+		// Repository of the issue
+		Owner string `bson:"owner"`
+		Repo  string `bson:"repo"`
+
+		// Author of the comment
+		User struct {
+			Login string `bson:"login"`
+		} `bson:"user"`
+	}
+
+	// ghIssueEvent represents an event, such as closed or assigned, of a
+	// GitHub issue.
+	ghIssueEvent struct {
+		ID        int64  `bson:"id"`
+		IssueID   int64  `bson:"issue_id"` // number of the issue
+		Event     string `bson:"event"`
+		CommitID  string `bson:"commit_id"`
+		CreatedAt string `bson:"created_at"`
+
+		// Repository of the issue
+		Owner string `bson:"owner"`
+		Repo  string `bson:"repo"`
+
+		// User who triggered the event, if any
+		Actor struct {
+			Login string `bson:"login"`
+		} `bson:"actor"`
+	}
+)
+
+// Tables fields
+var (
+	issuesFields = []string{
+		"repository_id",
+		"gh_user_id",
+		"assignee_id",
+		"github_id",
+		"number",
+		"title",
+		"body",
+		"state",
+		"comments_count",
+		"created_at",
+		"updated_at",
+		"closed_at",
+	}
+	issueCommentsFields = []string{
+		"gh_issue_id",
+		"gh_user_id",
+		"github_id",
+		"body",
+		"created_at",
+		"updated_at",
+	}
+	issueEventsFields = []string{
+		"gh_issue_id",
+		"gh_user_id",
+		"github_id",
+		"event",
+		"commit_id",
+		"created_at",
+	}
+)
+
+// issuesImporter imports BSON dumps containing GitHub issues into the DevMine
+// database.
+var issuesImporter = &importer{
+	constrained: []string{"gh_issues"},
+	queries:     []string{genInsQuery("gh_issues", issuesFields...)},
+	decode: func(bs []byte) (interface{}, error) {
+		ghi := ghIssue{}
+		err := bson.Unmarshal(bs, &ghi)
+		return ghi, err
+	},
+	key: func(doc interface{}) string {
+		return strconv.FormatInt(doc.(ghIssue).ID, 10)
+	},
+	insert: func(txn *sql.Tx, stmts []*sql.Stmt, doc interface{}, o origin) error {
+		ghi := doc.(ghIssue)
+		printVerbose("importing issue", ghi.Number, "of", ghi.Owner+"/"+ghi.Repo)
+		return insertIssue(txn, stmts[0], ghi)
+	},
+}
+
+// insertIssue inserts a GitHub issue into the database.
+func insertIssue(txn *sql.Tx, stmt *sql.Stmt, ghi ghIssue) error {
+	if !*nocheck {
+		if id := fetchIDFromGithubID(txn, "gh_issues", ghi.ID); id != 0 {
+			if id == -1 {
+				return fmt.Errorf("impossible to insert issue with github_id %d", ghi.ID)
+			}
+			return errAlreadyExists
+		}
+	}
+
+	fullname := ghi.Owner + "/" + ghi.Repo
+	repoID := fetchRepoIDFromFullname(txn, fullname)
+	if repoID <= 0 {
+		return fmt.Errorf("failed to retrieve the id of the repository having the full name %s", fullname)
+	}
+
+	ghUserID := fetchGhUserIDFromLogin(txn, ghi.User.Login)
+	if ghUserID <= 0 {
+		return fmt.Errorf("failed to retrieve the id of the github user having the login %s", ghi.User.Login)
+	}
+
+	// Most issues are not assigned to anybody.
+	var assigneeID *int64
+	if ghi.Assignee.Login != "" {
+		id := fetchGhUserIDFromLogin(txn, ghi.Assignee.Login)
+		if id <= 0 {
+			return fmt.Errorf("failed to retrieve the id of the github user having the login %s", ghi.Assignee.Login)
+		}
+		assigneeID = &id
+	}
+
+	_, err := stmt.Exec(
+		repoID,
+		ghUserID,
+		assigneeID,
+		ghi.ID,
+		ghi.Number,
+		removeNullByte(ghi.Title),
+		removeNullByte(ghi.Body),
+		ghi.State,
+		ghi.Comments,
+		nullIfEmpty(ghi.CreatedAt),
+		nullIfEmpty(ghi.UpdatedAt),
+		nullIfEmpty(ghi.ClosedAt))
+	if err != nil {
+		fail(err)
+		return fmt.Errorf("impossible to insert issue with github_id %d", ghi.ID)
+	}
+	return nil
+}
+
+// issueCommentsImporter imports BSON dumps containing comments on GitHub
+// issues into the DevMine database.
+var issueCommentsImporter = &importer{
+	constrained: []string{"gh_issue_comments"},
+	queries:     []string{genInsQuery("gh_issue_comments", issueCommentsFields...)},
+	decode: func(bs []byte) (interface{}, error) {
+		ghic := ghIssueComment{}
+		err := bson.Unmarshal(bs, &ghic)
+		return ghic, err
+	},
+	key: func(doc interface{}) string {
+		return strconv.FormatInt(doc.(ghIssueComment).ID, 10)
+	},
+	insert: func(txn *sql.Tx, stmts []*sql.Stmt, doc interface{}, o origin) error {
+		ghic := doc.(ghIssueComment)
+		printVerbose("importing comment", ghic.ID, "of issue", ghic.IssueID, "of", ghic.Owner+"/"+ghic.Repo)
+		return insertIssueComment(txn, stmts[0], ghic)
+	},
+}
+
+// insertIssueComment inserts a comment on a GitHub issue into the database.
+func insertIssueComment(txn *sql.Tx, stmt *sql.Stmt, ghic ghIssueComment) error {
+	if !*nocheck {
+		if id := fetchIDFromGithubID(txn, "gh_issue_comments", ghic.ID); id != 0 {
+			if id == -1 {
+				return fmt.Errorf("impossible to insert issue comment with github_id %d", ghic.ID)
+			}
+			return errAlreadyExists
+		}
+	}
+
+	fullname := ghic.Owner + "/" + ghic.Repo
+	issueID := fetchIssueID(txn, fullname, ghic.IssueID)
+	if issueID <= 0 {
+		return fmt.Errorf("failed to retrieve the id of the issue %d of %s", ghic.IssueID, fullname)
+	}
+
+	ghUserID := fetchGhUserIDFromLogin(txn, ghic.User.Login)
+	if ghUserID <= 0 {
+		return fmt.Errorf("failed to retrieve the id of the github user having the login %s", ghic.User.Login)
+	}
+
+	_, err := stmt.Exec(
+		issueID,
+		ghUserID,
+		ghic.ID,
+		removeNullByte(ghic.Body),
+		nullIfEmpty(ghic.CreatedAt),
+		nullIfEmpty(ghic.UpdatedAt))
+	if err != nil {
+		fail(err)
+		return fmt.Errorf("impossible to insert issue comment with github_id %d", ghic.ID)
+	}
+	return nil
+}
+
+// issueEventsImporter imports BSON dumps containing events of GitHub issues
+// into the DevMine database.
+var issueEventsImporter = &importer{
+	constrained: []string{"gh_issue_events"},
+	queries:     []string{genInsQuery("gh_issue_events", issueEventsFields...)},
+	decode: func(bs []byte) (interface{}, error) {
+		ghie := ghIssueEvent{}
+		err := bson.Unmarshal(bs, &ghie)
+		return ghie, err
+	},
+	key: func(doc interface{}) string {
+		return strconv.FormatInt(doc.(ghIssueEvent).ID, 10)
+	},
+	insert: func(txn *sql.Tx, stmts []*sql.Stmt, doc interface{}, o origin) error {
+		ghie := doc.(ghIssueEvent)
+		printVerbose("importing event", ghie.Event, "of issue", ghie.IssueID, "of", ghie.Owner+"/"+ghie.Repo)
+		return insertIssueEvent(txn, stmts[0], ghie)
+	},
+}
+
+// insertIssueEvent inserts an event of a GitHub issue into the database.
+func insertIssueEvent(txn *sql.Tx, stmt *sql.Stmt, ghie ghIssueEvent) error {
+	if !*nocheck {
+		if id := fetchIDFromGithubID(txn, "gh_issue_events", ghie.ID); id != 0 {
+			if id == -1 {
+				return fmt.Errorf("impossible to insert issue event with github_id %d", ghie.ID)
+			}
+			return errAlreadyExists
+		}
+	}
+
+	fullname := ghie.Owner + "/" + ghie.Repo
+	issueID := fetchIssueID(txn, fullname, ghie.IssueID)
+	if issueID <= 0 {
+		return fmt.Errorf("failed to retrieve the id of the issue %d of %s", ghie.IssueID, fullname)
+	}
+
+	// The actor of some events, such as events triggered by a deleted user,
+	// is unknown.
+	var actorID *int64
+	if ghie.Actor.Login != "" {
+		id := fetchGhUserIDFromLogin(txn, ghie.Actor.Login)
+		if id <= 0 {
+			return fmt.Errorf("failed to retrieve the id of the github user having the login %s", ghie.Actor.Login)
+		}
+		actorID = &id
+	}
+
+	_, err := stmt.Exec(
+		issueID,
+		actorID,
+		ghie.ID,
+		ghie.Event,
+		nullIfEmpty(ghie.CommitID),
+		nullIfEmpty(ghie.CreatedAt))
+	if err != nil {
+		fail(err)
+		return fmt.Errorf("impossible to insert issue event with github_id %d", ghie.ID)
+	}
+	return nil
+}
+
+// githubIDQuery returns the query of fetchIDFromGithubID for the given table.
+func githubIDQuery(table string) string {
+	return "SELECT " + table + ".id FROM " + table + " WHERE " + table + ".github_id=$1"
+}
+
+// fetchIDFromGithubID fetches the ID of the row of table having the given
+// GitHub ID. The table must have both an id and a github_id column.
+// It returns 0 if there is no such row in the database and -1 if an error
+// occured while processing the query.
+func fetchIDFromGithubID(txn *sql.Tx, table string, githubID int64) int64 {
+	var id int64
+	err := txn.QueryRow(githubIDQuery(table), githubID).Scan(&id)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return 0
+	case err != nil:
+		fail(fmt.Sprintf("failed to fetch %s id: ", table), err)
+		return -1
+	}
+
+	return id
+}
+
+// fetchIssueIDQuery is the query of fetchIssueID.
+const fetchIssueIDQuery = `
+	SELECT gh_issues.id
+	FROM gh_issues
+	LEFT JOIN gh_repositories ON gh_repositories.repository_id = gh_issues.repository_id
+	WHERE gh_repositories.full_name=$1 AND gh_issues.number=$2`
+
+// fetchIssueID fetches the ID of the issue having the given number in the
+// repository having the given full name.
+// It returns 0 if the issue does not already exists in the database and -1 if
+// an error occured while processing the query.
+func fetchIssueID(txn *sql.Tx, fullname string, number int64) int64 {
+	var id int64
+	err := txn.QueryRow(fetchIssueIDQuery, fullname, number).Scan(&id)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return 0
+	case err != nil:
+		fail("failed to fetch issue id: ", err)
+		return -1
+	}
+
+	return id
+}
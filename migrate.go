@@ -0,0 +1,1013 @@
+// Copyright 2014 The DevMine Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// migration is a numbered change of the part of the DevMine database schema
+// that ght2dm depends on. Migrations are applied in order and each of them is
+// recorded in the schema_version table.
+type migration struct {
+	version     int
+	description string
+
+	// up applies the migration and down reverts it. Both may contain several
+	// SQL statements. Migrations without down cannot be reverted.
+	up   string
+	down string
+}
+
+// migrations are the migrations of the database schema, ordered by version.
+// Applied migrations must never be modified: changes of the schema are made by
+// appending new migrations.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "DevMine tables",
+		// The DevMine tables are created and owned by the DevMine schema, not
+		// by ght2dm: the first migration only checks that they exist, so
+		// that the following ones, which add tables, columns and functions
+		// to them, do not fail halfway.
+		up: `
+		DO $$
+		DECLARE
+			missing text;
+		BEGIN
+			SELECT string_agg(t, ', ') INTO missing
+			FROM unnest(ARRAY[
+				'users', 'gh_users', 'gh_organizations', 'gh_users_organizations',
+				'repositories', 'gh_repositories', 'users_repositories', 'commits'
+			]) AS t
+			WHERE to_regclass(t) IS NULL;
+
+			IF missing IS NOT NULL THEN
+				RAISE EXCEPTION 'missing DevMine tables: %', missing
+					USING HINT = 'Create the DevMine database schema before applying the ght2dm migrations.';
+			END IF;
+		END
+		$$;
+		`,
+		// There is nothing to revert.
+	},
+	{
+		version:     2,
+		description: "followers and stargazers",
+		up: `
+		CREATE TABLE IF NOT EXISTS gh_followers (
+			gh_user_id integer NOT NULL,
+			gh_follower_id integer NOT NULL,
+			CONSTRAINT gh_followers_pk PRIMARY KEY (gh_user_id, gh_follower_id),
+			CONSTRAINT gh_followers_fk_users FOREIGN KEY (gh_user_id) REFERENCES gh_users(id),
+			CONSTRAINT gh_followers_fk_followers FOREIGN KEY (gh_follower_id) REFERENCES gh_users(id)
+		);
+
+		CREATE TABLE IF NOT EXISTS gh_stargazers (
+			gh_user_id integer NOT NULL,
+			repository_id integer NOT NULL,
+			CONSTRAINT gh_stargazers_pk PRIMARY KEY (gh_user_id, repository_id),
+			CONSTRAINT gh_stargazers_fk_users FOREIGN KEY (gh_user_id) REFERENCES gh_users(id),
+			CONSTRAINT gh_stargazers_fk_repositories FOREIGN KEY (repository_id) REFERENCES repositories(id)
+		);
+		`,
+		down: `
+		DROP TABLE IF EXISTS gh_followers, gh_stargazers;
+		`,
+	},
+	{
+		version:     3,
+		description: "issues, issue comments and issue events",
+		up: `
+		CREATE TABLE IF NOT EXISTS gh_issues (
+			id serial NOT NULL,
+			repository_id integer NOT NULL,
+			gh_user_id integer NOT NULL,
+			assignee_id integer,
+			github_id bigint NOT NULL,
+			number integer NOT NULL,
+			title character varying,
+			body text,
+			state character varying,
+			comments_count integer,
+			created_at timestamp with time zone,
+			updated_at timestamp with time zone,
+			closed_at timestamp with time zone,
+			CONSTRAINT gh_issues_pk PRIMARY KEY (id),
+			CONSTRAINT gh_issues_unique_github_id UNIQUE (github_id),
+			CONSTRAINT gh_issues_fk_repositories FOREIGN KEY (repository_id) REFERENCES repositories(id),
+			CONSTRAINT gh_issues_fk_users FOREIGN KEY (gh_user_id) REFERENCES gh_users(id),
+			CONSTRAINT gh_issues_fk_assignees FOREIGN KEY (assignee_id) REFERENCES gh_users(id)
+		);
+
+		CREATE TABLE IF NOT EXISTS gh_issue_comments (
+			id serial NOT NULL,
+			gh_issue_id integer NOT NULL,
+			gh_user_id integer NOT NULL,
+			github_id bigint NOT NULL,
+			body text,
+			created_at timestamp with time zone,
+			updated_at timestamp with time zone,
+			CONSTRAINT gh_issue_comments_pk PRIMARY KEY (id),
+			CONSTRAINT gh_issue_comments_unique_github_id UNIQUE (github_id),
+			CONSTRAINT gh_issue_comments_fk_issues FOREIGN KEY (gh_issue_id) REFERENCES gh_issues(id),
+			CONSTRAINT gh_issue_comments_fk_users FOREIGN KEY (gh_user_id) REFERENCES gh_users(id)
+		);
+
+		CREATE TABLE IF NOT EXISTS gh_issue_events (
+			id serial NOT NULL,
+			gh_issue_id integer NOT NULL,
+			gh_user_id integer,
+			github_id bigint NOT NULL,
+			event character varying NOT NULL,
+			commit_id character varying,
+			created_at timestamp with time zone,
+			CONSTRAINT gh_issue_events_pk PRIMARY KEY (id),
+			CONSTRAINT gh_issue_events_unique_github_id UNIQUE (github_id),
+			CONSTRAINT gh_issue_events_fk_issues FOREIGN KEY (gh_issue_id) REFERENCES gh_issues(id),
+			CONSTRAINT gh_issue_events_fk_users FOREIGN KEY (gh_user_id) REFERENCES gh_users(id)
+		);
+		`,
+		down: `
+		DROP TABLE IF EXISTS gh_issue_events, gh_issue_comments, gh_issues;
+		`,
+	},
+	{
+		version:     4,
+		description: "pull requests and pull request comments",
+		up: `
+		CREATE TABLE IF NOT EXISTS gh_pull_requests (
+			id serial NOT NULL,
+			repository_id integer NOT NULL,
+			head_repository_id integer,
+			gh_user_id integer NOT NULL,
+			github_id bigint NOT NULL,
+			number integer NOT NULL,
+			title character varying,
+			body text,
+			state character varying,
+			merged boolean,
+			merged_at timestamp with time zone,
+			head_ref character varying,
+			head_sha character varying,
+			base_ref character varying,
+			base_sha character varying,
+			created_at timestamp with time zone,
+			updated_at timestamp with time zone,
+			closed_at timestamp with time zone,
+			CONSTRAINT gh_pull_requests_pk PRIMARY KEY (id),
+			CONSTRAINT gh_pull_requests_unique_github_id UNIQUE (github_id),
+			CONSTRAINT gh_pull_requests_fk_repositories FOREIGN KEY (repository_id) REFERENCES repositories(id),
+			CONSTRAINT gh_pull_requests_fk_head_repositories FOREIGN KEY (head_repository_id) REFERENCES repositories(id),
+			CONSTRAINT gh_pull_requests_fk_users FOREIGN KEY (gh_user_id) REFERENCES gh_users(id)
+		);
+
+		CREATE TABLE IF NOT EXISTS gh_pull_request_comments (
+			id serial NOT NULL,
+			gh_pull_request_id integer NOT NULL,
+			gh_user_id integer NOT NULL,
+			github_id bigint NOT NULL,
+			body text,
+			path character varying,
+			position integer,
+			commit_id character varying,
+			created_at timestamp with time zone,
+			updated_at timestamp with time zone,
+			CONSTRAINT gh_pull_request_comments_pk PRIMARY KEY (id),
+			CONSTRAINT gh_pull_request_comments_unique_github_id UNIQUE (github_id),
+			CONSTRAINT gh_pull_request_comments_fk_pull_requests FOREIGN KEY (gh_pull_request_id) REFERENCES gh_pull_requests(id),
+			CONSTRAINT gh_pull_request_comments_fk_users FOREIGN KEY (gh_user_id) REFERENCES gh_users(id)
+		);
+		`,
+		down: `
+		DROP TABLE IF EXISTS gh_pull_request_comments, gh_pull_requests;
+		`,
+	},
+	{
+		version:     5,
+		description: "parent and source repositories of forks",
+		up: `
+		ALTER TABLE gh_repositories ADD COLUMN IF NOT EXISTS parent_full_name character varying;
+		ALTER TABLE gh_repositories ADD COLUMN IF NOT EXISTS source_full_name character varying;
+		ALTER TABLE gh_repositories ADD COLUMN IF NOT EXISTS parent_id integer
+			CONSTRAINT gh_repositories_fk_parent REFERENCES repositories(id);
+		ALTER TABLE gh_repositories ADD COLUMN IF NOT EXISTS source_id integer
+			CONSTRAINT gh_repositories_fk_source REFERENCES repositories(id);
+		`,
+		down: `
+		ALTER TABLE gh_repositories
+			DROP COLUMN IF EXISTS parent_full_name,
+			DROP COLUMN IF EXISTS source_full_name,
+			DROP COLUMN IF EXISTS parent_id,
+			DROP COLUMN IF EXISTS source_id;
+		`,
+	},
+	{
+		version:     6,
+		description: "import checkpoints",
+		up: `
+		CREATE TABLE IF NOT EXISTS ght2dm_checkpoints (
+			entity character varying NOT NULL,
+			dump_date date NOT NULL,
+			checksum character varying NOT NULL,
+			byte_offset bigint NOT NULL,
+			completed boolean NOT NULL,
+			updated_at timestamp with time zone NOT NULL,
+			CONSTRAINT ght2dm_checkpoints_pk PRIMARY KEY (entity, dump_date, checksum)
+		);
+		`,
+		down: `
+		DROP TABLE IF EXISTS ght2dm_checkpoints;
+		`,
+	},
+	{
+		version:     7,
+		description: "staging tables merge functions",
+		up: `
+		SET LOCAL check_function_bodies = false;
+
+		` + insertReposV7 + `
+
+		-- link forks to their parent and source repositories
+		--
+		-- The parent and the source of a fork are referenced by their full name, which
+		-- is kept in gh_repositories, so that forks imported before their origin
+		-- repository are linked as soon as the latter is imported.
+		CREATE OR REPLACE FUNCTION link_forks() RETURNS void AS
+		$BODY$
+		BEGIN
+			UPDATE gh_repositories AS gr
+			SET parent_id = p.repository_id
+			FROM gh_repositories AS p
+			WHERE gr.fork AND gr.parent_id IS NULL AND p.full_name = gr.parent_full_name;
+
+			UPDATE gh_repositories AS gr
+			SET source_id = s.repository_id
+			FROM gh_repositories AS s
+			WHERE gr.fork AND gr.source_id IS NULL AND s.full_name = gr.source_full_name;
+		END
+		$BODY$
+		LANGUAGE plpgsql;
+
+		` + insertCommitsV7 + `
+		`,
+		down: `
+		DROP FUNCTION IF EXISTS insert_repos();
+		DROP FUNCTION IF EXISTS link_forks();
+		DROP FUNCTION IF EXISTS insert_commits();
+		`,
+	},
+	{
+		version:     8,
+		description: "refresh of users, organizations and repositories",
+		up: `
+		SET LOCAL check_function_bodies = false;
+
+		-- rows are upserted by GitHub ID in update mode
+		DO $$
+		BEGIN
+			IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'gh_users_unique_github_id') THEN
+				ALTER TABLE gh_users ADD CONSTRAINT gh_users_unique_github_id UNIQUE (github_id);
+			END IF;
+			IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'gh_organizations_unique_github_id') THEN
+				ALTER TABLE gh_organizations ADD CONSTRAINT gh_organizations_unique_github_id UNIQUE (github_id);
+			END IF;
+			IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'gh_repositories_unique_github_id') THEN
+				ALTER TABLE gh_repositories ADD CONSTRAINT gh_repositories_unique_github_id UNIQUE (github_id);
+			END IF;
+		END
+		$$;
+
+		` + refreshReposV8 + `
+		`,
+		down: `
+		DROP FUNCTION IF EXISTS refresh_repos();
+		`,
+	},
+	{
+		version:     9,
+		description: "merge of repositories without dropping constraints",
+		up: `
+		SET LOCAL check_function_bodies = false;
+
+		` + insertReposV9 + `
+		`,
+		down: `
+		SET LOCAL check_function_bodies = false;
+
+		` + insertReposV7 + `
+		`,
+	},
+	{
+		version:     10,
+		description: "number of rows merged from the staging tables",
+		up: `
+		SET LOCAL check_function_bodies = false;
+
+		-- the return type of a function cannot be changed by CREATE OR REPLACE
+		DROP FUNCTION IF EXISTS insert_repos();
+		DROP FUNCTION IF EXISTS insert_commits();
+
+		-- insert repos into repositories and gh_repositories from tmp_gh_repositories table
+		--
+		-- Constraints are left in place: staged repositories whose clone path, clone
+		-- URL or GitHub ID is already in the database, including those inserted by a
+		-- previous iteration of the loop, are skipped. The number of repositories
+		-- inserted is returned.
+		CREATE FUNCTION insert_repos() RETURNS integer AS
+		$BODY$
+		DECLARE
+			repo_id repositories.id%TYPE;
+			repo tmp_gh_repositories%ROWTYPE;
+			inserted integer := 0;
+		BEGIN
+			FOR repo IN
+				-- get all non already inserted repositories, without duplicates
+				SELECT DISTINCT
+					tgr.name,
+					tgr.primary_language,
+					tgr.clone_url,
+					tgr.clone_path,
+					tgr.vcs,
+					tgr.github_id,
+					tgr.full_name,
+					tgr.description,
+					tgr.homepage,
+					tgr.fork,
+					tgr.default_branch,
+					tgr.master_branch,
+					tgr.html_url,
+					tgr.forks_count,
+					tgr.open_issues_count,
+					tgr.stargazers_count,
+					tgr.subscribers_count,
+					tgr.watchers_count,
+					tgr.size_in_kb,
+					tgr.created_at,
+					tgr.updated_at,
+					tgr.pushed_at,
+					tgr.parent_full_name,
+					tgr.source_full_name
+				FROM tmp_gh_repositories AS tgr
+				INNER JOIN (
+					SELECT
+						clone_path,
+						max(updated_at) AS max_updated_at,
+						max(pushed_at) AS max_pushed_at,
+						min(open_issues_count) AS max_open_issues_count
+					FROM tmp_gh_repositories
+					GROUP BY clone_path) AS tmp ON (
+						tmp.clone_path = tgr.clone_path AND
+						tmp.max_updated_at = tgr.updated_at AND
+						tmp.max_pushed_at = tgr.pushed_at AND
+						tmp.max_open_issues_count = tgr.open_issues_count
+					)
+				LEFT JOIN gh_repositories AS gr ON tgr.github_id = gr.github_id
+				LEFT JOIN repositories AS r ON (tgr.clone_path = r.clone_path AND tgr.primary_language = r.primary_language)
+				WHERE gr.id IS NULL AND r.id IS NULL AND tgr.clone_url <> '' AND tgr.clone_path <> '' AND tgr.primary_language <> ''
+			LOOP
+				IF EXISTS (SELECT 1 FROM repositories WHERE clone_path = repo.clone_path OR clone_url = repo.clone_url)
+					OR EXISTS (SELECT 1 FROM gh_repositories WHERE github_id = repo.github_id) THEN
+					CONTINUE;
+				END IF;
+
+				-- create repositories
+				INSERT INTO repositories (name, primary_language, clone_url, clone_path, vcs)
+				VALUES (repo.name, repo.primary_language, repo.clone_url, repo.clone_path, repo.vcs)
+				RETURNING id INTO repo_id;
+
+				-- create gh_repositories
+				INSERT INTO gh_repositories (repository_id, github_id, full_name, description, homepage, fork, default_branch, master_branch, html_url, forks_count, open_issues_count, stargazers_count, subscribers_count, watchers_count, size_in_kb, created_at, updated_at, pushed_at, parent_full_name, source_full_name)
+				VALUES(
+					repo_id,
+					repo.github_id,
+					repo.full_name,
+					repo.description,
+					repo.homepage,
+					repo.fork,
+					repo.default_branch,
+					repo.master_branch,
+					repo.html_url,
+					repo.forks_count,
+					repo.open_issues_count,
+					repo.stargazers_count,
+					repo.subscribers_count,
+					repo.watchers_count,
+					repo.size_in_kb,
+					repo.created_at,
+					repo.updated_at,
+					repo.pushed_at,
+					repo.parent_full_name,
+					repo.source_full_name
+				);
+
+				inserted := inserted + 1;
+			END LOOP;
+			RETURN inserted;
+		END
+		$BODY$
+		LANGUAGE plpgsql;
+
+		-- insert commits into commits from tmp_gh_commits table
+		--
+		-- Commits are linked to their repository through the full name of the GitHub
+		-- repository and to their author and committer through their GitHub login.
+		-- Commits of repositories that are not in the database are ignored. The number
+		-- of commits inserted is returned.
+		CREATE FUNCTION insert_commits() RETURNS integer AS
+		$BODY$
+		DECLARE
+			inserted integer;
+		BEGIN
+			INSERT INTO commits (repository_id, author_id, committer_id, vcs_id, message, author_date, commit_date, file_changed_count, insertions_count, deletions_count)
+			-- get all non already inserted commits, without duplicates
+			SELECT DISTINCT ON (r.id, tgc.vcs_id)
+				r.id,
+				au.user_id,
+				cu.user_id,
+				tgc.vcs_id,
+				tgc.message,
+				tgc.author_date,
+				tgc.commit_date,
+				tgc.file_changed_count,
+				tgc.insertions_count,
+				tgc.deletions_count
+			FROM tmp_gh_commits AS tgc
+			INNER JOIN gh_repositories AS gr ON gr.full_name = tgc.repository_full_name
+			INNER JOIN repositories AS r ON r.id = gr.repository_id
+			LEFT JOIN gh_users AS au ON au.login = tgc.author_login
+			LEFT JOIN gh_users AS cu ON cu.login = tgc.committer_login
+			LEFT JOIN commits AS c ON (c.repository_id = r.id AND c.vcs_id = tgc.vcs_id)
+			WHERE c.id IS NULL;
+
+			GET DIAGNOSTICS inserted = ROW_COUNT;
+			RETURN inserted;
+		END
+		$BODY$
+		LANGUAGE plpgsql;
+		`,
+		down: `
+		SET LOCAL check_function_bodies = false;
+
+		DROP FUNCTION IF EXISTS insert_repos();
+		DROP FUNCTION IF EXISTS insert_commits();
+
+		` + insertReposV9 + `
+		` + insertCommitsV7 + `
+		`,
+	},
+	{
+		version:     11,
+		description: "refresh of repositories and number of rows refreshed",
+		up: `
+		SET LOCAL check_function_bodies = false;
+
+		-- the return type of a function cannot be changed by CREATE OR REPLACE
+		DROP FUNCTION IF EXISTS refresh_repos();
+
+		-- refresh repositories and gh_repositories with the more recent repositories of
+		-- tmp_gh_repositories table
+		--
+		-- A repository is only refreshed when the last modification date of the
+		-- staged repository is more recent than its own, if any: staged repositories
+		-- without any date never replace an existing row. The name, primary language,
+		-- clone URL and clone path of the repository are refreshed as well, unless
+		-- the clone URL or clone path is already used by another repository. Forks
+		-- whose parent or source changed are linked again by link_forks(). The number
+		-- of repositories refreshed is returned.
+		CREATE FUNCTION refresh_repos() RETURNS integer AS
+		$BODY$
+		DECLARE
+			refreshed integer;
+		BEGIN
+			WITH tgr AS (
+				SELECT DISTINCT ON (github_id) *
+				FROM tmp_gh_repositories
+				WHERE updated_at IS NOT NULL
+				ORDER BY github_id, updated_at DESC
+			), ghr AS (
+				UPDATE gh_repositories AS gr
+				SET
+					full_name = tgr.full_name,
+					description = tgr.description,
+					homepage = tgr.homepage,
+					fork = tgr.fork,
+					default_branch = tgr.default_branch,
+					master_branch = tgr.master_branch,
+					html_url = tgr.html_url,
+					forks_count = tgr.forks_count,
+					open_issues_count = tgr.open_issues_count,
+					stargazers_count = tgr.stargazers_count,
+					subscribers_count = tgr.subscribers_count,
+					watchers_count = tgr.watchers_count,
+					size_in_kb = tgr.size_in_kb,
+					created_at = tgr.created_at,
+					updated_at = tgr.updated_at,
+					pushed_at = tgr.pushed_at,
+					parent_full_name = tgr.parent_full_name,
+					source_full_name = tgr.source_full_name,
+					parent_id = CASE WHEN gr.parent_full_name IS DISTINCT FROM tgr.parent_full_name THEN NULL ELSE gr.parent_id END,
+					source_id = CASE WHEN gr.source_full_name IS DISTINCT FROM tgr.source_full_name THEN NULL ELSE gr.source_id END
+				FROM tgr
+				WHERE gr.github_id = tgr.github_id AND (gr.updated_at IS NULL OR gr.updated_at < tgr.updated_at)
+				RETURNING gr.repository_id, tgr.name, tgr.primary_language, tgr.clone_url, tgr.clone_path
+			), repos AS (
+				-- the clone URL and clone path of a repository are unique: they are
+				-- left as they are when used by another repository, before or after
+				-- the refresh
+				UPDATE repositories AS r
+				SET
+					name = ghr.name,
+					primary_language = ghr.primary_language,
+					clone_url = ghr.clone_url,
+					clone_path = ghr.clone_path
+				FROM ghr
+				WHERE r.id = ghr.repository_id
+					AND ghr.clone_url <> '' AND ghr.clone_path <> '' AND ghr.primary_language <> ''
+					AND NOT EXISTS (
+						SELECT 1 FROM repositories AS o
+						WHERE o.id <> r.id AND (o.clone_url = ghr.clone_url OR o.clone_path = ghr.clone_path))
+					AND NOT EXISTS (
+						SELECT 1 FROM ghr AS o
+						WHERE o.repository_id <> r.id AND (o.clone_url = ghr.clone_url OR o.clone_path = ghr.clone_path))
+				RETURNING r.id
+			)
+			SELECT count(*) INTO refreshed FROM ghr;
+			RETURN refreshed;
+		END
+		$BODY$
+		LANGUAGE plpgsql;
+		`,
+		down: `
+		SET LOCAL check_function_bodies = false;
+
+		DROP FUNCTION IF EXISTS refresh_repos();
+
+		` + refreshReposV8 + `
+		`,
+	},
+}
+
+// insertReposV7 is the insert_repos() function created by migration 7, which
+// drops the constraints of the repositories tables for the time of the merge.
+// It is restored when migration 9 is reverted.
+const insertReposV7 = `
+		-- insert repos into repositories and gh_repositories from tmp_gh_repositories table
+		CREATE OR REPLACE FUNCTION insert_repos() RETURNS void AS
+		$BODY$
+		DECLARE
+			repo_id repositories.id%TYPE;
+			repo tmp_gh_repositories%ROWTYPE;
+		BEGIN
+			-- disable constraints
+			ALTER TABLE ONLY repositories DROP CONSTRAINT repositories_unique_clone_path;
+			ALTER TABLE ONLY repositories DROP CONSTRAINT repositories_unique_clone_url;
+			ALTER TABLE ONLY gh_repositories DROP CONSTRAINT gh_repositories_fk_repositories;
+
+			FOR repo IN
+				-- get all non already inserted repositories, without duplicates
+				SELECT DISTINCT
+					tgr.name,
+					tgr.primary_language,
+					tgr.clone_url,
+					tgr.clone_path,
+					tgr.vcs,
+					tgr.github_id,
+					tgr.full_name,
+					tgr.description,
+					tgr.homepage,
+					tgr.fork,
+					tgr.default_branch,
+					tgr.master_branch,
+					tgr.html_url,
+					tgr.forks_count,
+					tgr.open_issues_count,
+					tgr.stargazers_count,
+					tgr.subscribers_count,
+					tgr.watchers_count,
+					tgr.size_in_kb,
+					tgr.created_at,
+					tgr.updated_at,
+					tgr.pushed_at,
+					tgr.parent_full_name,
+					tgr.source_full_name
+				FROM tmp_gh_repositories AS tgr
+				INNER JOIN (
+					SELECT
+						clone_path,
+						max(updated_at) AS max_updated_at,
+						max(pushed_at) AS max_pushed_at,
+						min(open_issues_count) AS max_open_issues_count
+					FROM tmp_gh_repositories
+					GROUP BY clone_path) AS tmp ON (
+						tmp.clone_path = tgr.clone_path AND
+						tmp.max_updated_at = tgr.updated_at AND
+						tmp.max_pushed_at = tgr.pushed_at AND
+						tmp.max_open_issues_count = tgr.open_issues_count
+					)
+				LEFT JOIN gh_repositories AS gr ON tgr.github_id = gr.github_id
+				LEFT JOIN repositories AS r ON (tgr.clone_path = r.clone_path AND tgr.primary_language = r.primary_language)
+				WHERE gr.id IS NULL AND r.id IS NULL AND tgr.clone_url <> '' AND tgr.clone_path <> '' AND tgr.primary_language <> ''
+			LOOP
+				-- raise notice 'Value: %', repo;
+
+				-- create repositories
+				INSERT INTO repositories (name, primary_language, clone_url, clone_path, vcs)
+				VALUES (repo.name, repo.primary_language, repo.clone_url, repo.clone_path, repo.vcs)
+				RETURNING id INTO repo_id;
+
+				-- create gh_repositories
+				INSERT INTO gh_repositories (repository_id, github_id, full_name, description, homepage, fork, default_branch, master_branch, html_url, forks_count, open_issues_count, stargazers_count, subscribers_count, watchers_count, size_in_kb, created_at, updated_at, pushed_at, parent_full_name, source_full_name)
+				VALUES(
+					repo_id,
+					repo.github_id,
+					repo.full_name,
+					repo.description,
+					repo.homepage,
+					repo.fork,
+					repo.default_branch,
+					repo.master_branch,
+					repo.html_url,
+					repo.forks_count,
+					repo.open_issues_count,
+					repo.stargazers_count,
+					repo.subscribers_count,
+					repo.watchers_count,
+					repo.size_in_kb,
+					repo.created_at,
+					repo.updated_at,
+					repo.pushed_at,
+					repo.parent_full_name,
+					repo.source_full_name
+				);
+			END LOOP;
+
+			-- re-enable constraints
+			ALTER TABLE ONLY repositories ADD CONSTRAINT repositories_unique_clone_path UNIQUE (clone_path);
+			ALTER TABLE ONLY repositories ADD CONSTRAINT repositories_unique_clone_url UNIQUE (clone_url);
+			ALTER TABLE ONLY gh_repositories ADD CONSTRAINT gh_repositories_fk_repositories FOREIGN KEY (repository_id) REFERENCES repositories(id);
+		END
+		$BODY$
+		LANGUAGE plpgsql;
+		`
+
+// insertReposV9 is the insert_repos() function created by migration 9, which
+// does not return the number of repositories inserted. It is restored when
+// migration 10 is reverted.
+const insertReposV9 = `
+		-- insert repos into repositories and gh_repositories from tmp_gh_repositories table
+		--
+		-- Constraints are left in place: staged repositories whose clone path, clone
+		-- URL or GitHub ID is already in the database, including those inserted by a
+		-- previous iteration of the loop, are skipped.
+		CREATE OR REPLACE FUNCTION insert_repos() RETURNS void AS
+		$BODY$
+		DECLARE
+			repo_id repositories.id%TYPE;
+			repo tmp_gh_repositories%ROWTYPE;
+		BEGIN
+			FOR repo IN
+				-- get all non already inserted repositories, without duplicates
+				SELECT DISTINCT
+					tgr.name,
+					tgr.primary_language,
+					tgr.clone_url,
+					tgr.clone_path,
+					tgr.vcs,
+					tgr.github_id,
+					tgr.full_name,
+					tgr.description,
+					tgr.homepage,
+					tgr.fork,
+					tgr.default_branch,
+					tgr.master_branch,
+					tgr.html_url,
+					tgr.forks_count,
+					tgr.open_issues_count,
+					tgr.stargazers_count,
+					tgr.subscribers_count,
+					tgr.watchers_count,
+					tgr.size_in_kb,
+					tgr.created_at,
+					tgr.updated_at,
+					tgr.pushed_at,
+					tgr.parent_full_name,
+					tgr.source_full_name
+				FROM tmp_gh_repositories AS tgr
+				INNER JOIN (
+					SELECT
+						clone_path,
+						max(updated_at) AS max_updated_at,
+						max(pushed_at) AS max_pushed_at,
+						min(open_issues_count) AS max_open_issues_count
+					FROM tmp_gh_repositories
+					GROUP BY clone_path) AS tmp ON (
+						tmp.clone_path = tgr.clone_path AND
+						tmp.max_updated_at = tgr.updated_at AND
+						tmp.max_pushed_at = tgr.pushed_at AND
+						tmp.max_open_issues_count = tgr.open_issues_count
+					)
+				LEFT JOIN gh_repositories AS gr ON tgr.github_id = gr.github_id
+				LEFT JOIN repositories AS r ON (tgr.clone_path = r.clone_path AND tgr.primary_language = r.primary_language)
+				WHERE gr.id IS NULL AND r.id IS NULL AND tgr.clone_url <> '' AND tgr.clone_path <> '' AND tgr.primary_language <> ''
+			LOOP
+				IF EXISTS (SELECT 1 FROM repositories WHERE clone_path = repo.clone_path OR clone_url = repo.clone_url)
+					OR EXISTS (SELECT 1 FROM gh_repositories WHERE github_id = repo.github_id) THEN
+					CONTINUE;
+				END IF;
+
+				-- create repositories
+				INSERT INTO repositories (name, primary_language, clone_url, clone_path, vcs)
+				VALUES (repo.name, repo.primary_language, repo.clone_url, repo.clone_path, repo.vcs)
+				RETURNING id INTO repo_id;
+
+				-- create gh_repositories
+				INSERT INTO gh_repositories (repository_id, github_id, full_name, description, homepage, fork, default_branch, master_branch, html_url, forks_count, open_issues_count, stargazers_count, subscribers_count, watchers_count, size_in_kb, created_at, updated_at, pushed_at, parent_full_name, source_full_name)
+				VALUES(
+					repo_id,
+					repo.github_id,
+					repo.full_name,
+					repo.description,
+					repo.homepage,
+					repo.fork,
+					repo.default_branch,
+					repo.master_branch,
+					repo.html_url,
+					repo.forks_count,
+					repo.open_issues_count,
+					repo.stargazers_count,
+					repo.subscribers_count,
+					repo.watchers_count,
+					repo.size_in_kb,
+					repo.created_at,
+					repo.updated_at,
+					repo.pushed_at,
+					repo.parent_full_name,
+					repo.source_full_name
+				);
+			END LOOP;
+		END
+		$BODY$
+		LANGUAGE plpgsql;
+		`
+
+// insertCommitsV7 is the insert_commits() function created by migration 7,
+// which does not return the number of commits inserted. It is restored when
+// migration 10 is reverted.
+const insertCommitsV7 = `
+		-- insert commits into commits from tmp_gh_commits table
+		--
+		-- Commits are linked to their repository through the full name of the GitHub
+		-- repository and to their author and committer through their GitHub login.
+		-- Commits of repositories that are not in the database are ignored.
+		CREATE OR REPLACE FUNCTION insert_commits() RETURNS void AS
+		$BODY$
+		BEGIN
+			INSERT INTO commits (repository_id, author_id, committer_id, vcs_id, message, author_date, commit_date, file_changed_count, insertions_count, deletions_count)
+			-- get all non already inserted commits, without duplicates
+			SELECT DISTINCT ON (r.id, tgc.vcs_id)
+				r.id,
+				au.user_id,
+				cu.user_id,
+				tgc.vcs_id,
+				tgc.message,
+				tgc.author_date,
+				tgc.commit_date,
+				tgc.file_changed_count,
+				tgc.insertions_count,
+				tgc.deletions_count
+			FROM tmp_gh_commits AS tgc
+			INNER JOIN gh_repositories AS gr ON gr.full_name = tgc.repository_full_name
+			INNER JOIN repositories AS r ON r.id = gr.repository_id
+			LEFT JOIN gh_users AS au ON au.login = tgc.author_login
+			LEFT JOIN gh_users AS cu ON cu.login = tgc.committer_login
+			LEFT JOIN commits AS c ON (c.repository_id = r.id AND c.vcs_id = tgc.vcs_id)
+			WHERE c.id IS NULL;
+		END
+		$BODY$
+		LANGUAGE plpgsql;
+		`
+
+// refreshReposV8 is the refresh_repos() function created by migration 8,
+// which only refreshes gh_repositories. It is restored when migration 11 is
+// reverted.
+const refreshReposV8 = `
+		-- refresh gh_repositories with the more recent repositories of tmp_gh_repositories table
+		--
+		-- A repository is only refreshed when its last modification date is
+		-- older than the one of the staged repository. Forks whose parent or
+		-- source changed are linked again by link_forks().
+		CREATE OR REPLACE FUNCTION refresh_repos() RETURNS void AS
+		$BODY$
+		BEGIN
+			UPDATE gh_repositories AS gr
+			SET
+				full_name = tgr.full_name,
+				description = tgr.description,
+				homepage = tgr.homepage,
+				fork = tgr.fork,
+				default_branch = tgr.default_branch,
+				master_branch = tgr.master_branch,
+				html_url = tgr.html_url,
+				forks_count = tgr.forks_count,
+				open_issues_count = tgr.open_issues_count,
+				stargazers_count = tgr.stargazers_count,
+				subscribers_count = tgr.subscribers_count,
+				watchers_count = tgr.watchers_count,
+				size_in_kb = tgr.size_in_kb,
+				created_at = tgr.created_at,
+				updated_at = tgr.updated_at,
+				pushed_at = tgr.pushed_at,
+				parent_full_name = tgr.parent_full_name,
+				source_full_name = tgr.source_full_name,
+				parent_id = CASE WHEN gr.parent_full_name IS DISTINCT FROM tgr.parent_full_name THEN NULL ELSE gr.parent_id END,
+				source_id = CASE WHEN gr.source_full_name IS DISTINCT FROM tgr.source_full_name THEN NULL ELSE gr.source_id END
+			FROM (
+				SELECT DISTINCT ON (github_id) *
+				FROM tmp_gh_repositories
+				ORDER BY github_id, updated_at DESC NULLS LAST
+			) AS tgr
+			WHERE gr.github_id = tgr.github_id AND (gr.updated_at IS NULL OR gr.updated_at < tgr.updated_at);
+		END
+		$BODY$
+		LANGUAGE plpgsql;
+		`
+
+// schemaVersion returns the version of the latest migration known by ght2dm.
+func schemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// createSchemaVersionTable creates the schema_version table, which records the
+// migrations applied to the database, if it does not exist yet.
+func createSchemaVersionTable() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version integer NOT NULL,
+			description character varying NOT NULL,
+			applied_at timestamp with time zone NOT NULL,
+			CONSTRAINT schema_version_pk PRIMARY KEY (version)
+		)`)
+	return err
+}
+
+// fetchSchemaVersion returns the version of the latest migration applied to
+// the database, 0 if none was applied.
+func fetchSchemaVersion() (int, error) {
+	var exists bool
+	err := db.QueryRow("SELECT to_regclass('schema_version') IS NOT NULL").Scan(&exists)
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	var version int
+	err = db.QueryRow("SELECT coalesce(max(version), 0) FROM schema_version").Scan(&version)
+	return version, err
+}
+
+// checkSchemaVersion checks that the database schema is at the version
+// expected by ght2dm. It must be called before starting an import.
+func checkSchemaVersion() error {
+	version, err := fetchSchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	switch latest := schemaVersion(); {
+	case version < latest:
+		return fmt.Errorf("database schema is at version %d, expected %d: run 'ght2dm migrate up'", version, latest)
+	case version > latest:
+		return fmt.Errorf("database schema is at version %d, which is newer than the version %d supported by ght2dm", version, latest)
+	}
+	return nil
+}
+
+// migrate runs the given migrate command: "up" applies all the pending
+// migrations, "down" reverts the latest applied migration and "status" lists
+// the migrations and whether they are applied.
+func migrate(cmd string) error {
+	switch cmd {
+	case "up":
+		return migrateUp()
+	case "down":
+		return migrateDown()
+	case "status":
+		return migrateStatus()
+	}
+	return fmt.Errorf("unknown migrate command '%s' (expected up, down or status)", cmd)
+}
+
+// migrateUp applies all the pending migrations, each of them within its own
+// transaction.
+func migrateUp() error {
+	if err := createSchemaVersionTable(); err != nil {
+		return err
+	}
+
+	version, err := fetchSchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version > schemaVersion() {
+		return fmt.Errorf("database schema is at version %d, which is newer than the version %d supported by ght2dm", version, schemaVersion())
+	}
+
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+
+		fmt.Printf("applying migration %d: %s\n", m.version, m.description)
+		err := inTxn(func(txn *sql.Tx) error {
+			if _, err := txn.Exec(m.up); err != nil {
+				return err
+			}
+			_, err := txn.Exec(
+				"INSERT INTO schema_version (version, description, applied_at) VALUES ($1, $2, $3)",
+				m.version, m.description, time.Now())
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d: %v", m.version, err)
+		}
+	}
+	return nil
+}
+
+// migrateDown reverts the latest applied migration.
+func migrateDown() error {
+	version, err := fetchSchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version == 0 {
+		fmt.Println("no migration to revert")
+		return nil
+	}
+
+	var m *migration
+	for i := range migrations {
+		if migrations[i].version == version {
+			m = &migrations[i]
+		}
+	}
+	if m == nil {
+		return fmt.Errorf("database schema is at version %d, which is unknown to ght2dm", version)
+	}
+	if m.down == "" {
+		return fmt.Errorf("migration %d (%s) cannot be reverted", m.version, m.description)
+	}
+
+	fmt.Printf("reverting migration %d: %s\n", m.version, m.description)
+	err = inTxn(func(txn *sql.Tx) error {
+		if _, err := txn.Exec(m.down); err != nil {
+			return err
+		}
+		_, err := txn.Exec("DELETE FROM schema_version WHERE version=$1", m.version)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("migration %d: %v", m.version, err)
+	}
+	return nil
+}
+
+// migrateStatus prints the migrations known by ght2dm and whether they are
+// applied to the database.
+func migrateStatus() error {
+	version, err := fetchSchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		status := "pending"
+		if m.version <= version {
+			status = "applied"
+		}
+		fmt.Printf("%3d  %-8s %s\n", m.version, status, m.description)
+	}
+	if version > schemaVersion() {
+		fmt.Printf("database schema is at version %d, which is newer than the version %d supported by ght2dm\n", version, schemaVersion())
+	}
+	return nil
+}
+
+// inTxn calls f within a new transaction, which is committed if f succeeds and
+// rolled back otherwise.
+func inTxn(f func(txn *sql.Tx) error) error {
+	txn, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	if err := f(txn); err != nil {
+		return err
+	}
+	return txn.Commit()
+}
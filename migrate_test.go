@@ -0,0 +1,28 @@
+// Copyright 2014 The DevMine Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestMigrations(t *testing.T) {
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("migration %d has version %d, want %d", i, m.version, i+1)
+		}
+		if m.up == "" {
+			t.Errorf("migration %d does not apply anything", m.version)
+		}
+	}
+
+	// The first migration only checks that the DevMine tables exist.
+	if migrations[0].down != "" {
+		t.Error("migration 1 can be reverted")
+	}
+	for _, m := range migrations[1:] {
+		if m.down == "" {
+			t.Errorf("migration %d cannot be reverted", m.version)
+		}
+	}
+}
@@ -0,0 +1,730 @@
+// Copyright 2014 The DevMine Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"database/sql"
+	"hash/fnv"
+	"io"
+	"sync"
+)
+
+// importer describes how the documents of a BSON dump containing a given
+// GitHub entity are imported into the DevMine database.
+//
+// Documents are read sequentially from the dump, decoded by a pool of decoders
+// and written by one or more writers, each of them having its own transaction
+// and its own prepared statements.
+type importer struct {
+	// constrained are the tables written by the importer whose foreign key
+	// constraints are deferred during the import (see deferConstraints).
+	constrained []string
+
+	// setup are the statements executed by each writer, within its
+	// transaction, before preparing its queries. They typically create
+	// staging tables.
+	setup []string
+
+	// queries are the queries prepared by each writer, in the order in which
+	// they are passed to insert.
+	queries []string
+
+	// copyIn tells whether queries are COPY statements (see pq.CopyIn), which
+	// must be flushed before being closed.
+	copyIn bool
+
+	// decode unmarshals a BSON document.
+	decode func(bs []byte) (interface{}, error)
+
+	// key returns the key of a decoded document. Documents having the same
+	// key are written by the same writer, in the order in which they appear
+	// in the dump, so that duplicates within a dump are detected. When key
+	// is nil, documents are evenly dispatched among the writers.
+	key func(doc interface{}) string
+
+	// insert inserts a decoded document, coming from o, into the database,
+	// using the statements prepared from queries. It returns
+	// errAlreadyExists when the document is skipped because it is already in
+	// the database. Importers copying documents into staging tables copy
+	// their origin along with them (see unresolved).
+	insert func(txn *sql.Tx, stmts []*sql.Stmt, doc interface{}, o origin) error
+
+	// validate checks a decoded document the way insert does, without
+	// accessing the database, and returns the kind of the document (eg.
+	// users or organizations). It is only used in dry-run mode and, when it
+	// is nil, documents are considered valid and of the kind of the entity.
+	validate func(doc interface{}) (string, error)
+
+	// refresh are the statements executed by each writer in update mode, once
+	// all its documents have been inserted and before merge. They typically
+	// refresh existing rows with the more recent rows of staging tables, the
+	// rows they update being the documents refreshed.
+	refresh []string
+
+	// merge are the statements executed by each writer, within its
+	// transaction, once all its documents have been inserted. They typically
+	// merge staging tables into the DevMine tables.
+	merge []string
+
+	// uncounted is the number of leading merge statements whose rows are not
+	// documents of the dump, such as the users created along with GitHub
+	// users. The rows inserted by the following ones are the documents
+	// merged into the DevMine tables.
+	uncounted int
+
+	// unresolved is the query returning, before merge, the origin of the
+	// rows of the staging tables that refer to entities missing from the
+	// database, and thus fail to be merged, as dump_name, dump_offset and
+	// document columns. These rows are written to the dead-letter file.
+	unresolved string
+}
+
+// importDump imports the BSON dump read from f, starting at the given
+// checkpoint, and counts its documents in the report rep, whose name
+// identifies the dump in messages.
+func (imp *importer) importDump(f io.Reader, cp *checkpoint, rep *dumpReport) error {
+	r := newDumpReader(f, *maxDocSize)
+	if err := cp.resume(r); err != nil {
+		return err
+	}
+
+	if *batchSize > 0 {
+		return imp.importDumpInBatches(r, cp, rep)
+	}
+	if *nbWriters > 1 {
+		return imp.importDumpConcurrently(r, cp, rep)
+	}
+
+	// Begin a new transaction.
+	txn, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	w, err := imp.newWriter(txn, *alterFKs)
+	if err != nil {
+		return err
+	}
+	if err := imp.run(r, rep, []*writer{w}, nil); err != nil {
+		return err
+	}
+	if err := closeWriters([]*writer{w}, rep, true); err != nil {
+		return err
+	}
+
+	if err := cp.record(txn, r.Offset(), true); err != nil {
+		return err
+	}
+	if err := txn.Commit(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// importDumpConcurrently imports the BSON dump read from r using several
+// writers, each of them having its own transaction.
+//
+// Foreign key constraints that are not deferrable are left as they are, since
+// making them deferrable would lock their table for the other writers.
+func (imp *importer) importDumpConcurrently(r *dumpReader, cp *checkpoint, rep *dumpReport) error {
+	if err := imp.runWriters(r, rep); err != nil {
+		return err
+	}
+
+	txn, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	if err := cp.record(txn, r.Offset(), true); err != nil {
+		return err
+	}
+	if err := txn.Commit(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// runWriters imports the documents read from r using *nbWriters writers and
+// commits their transactions once all the documents have been written.
+func (imp *importer) runWriters(r *dumpReader, rep *dumpReport) error {
+	ws := make([]*writer, *nbWriters)
+	for i := range ws {
+		txn, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer txn.Rollback()
+
+		if ws[i], err = imp.newWriter(txn, false); err != nil {
+			return err
+		}
+	}
+
+	if err := imp.run(r, rep, ws, nil); err != nil {
+		return err
+	}
+
+	if err := closeWriters(ws, rep, true); err != nil {
+		return err
+	}
+	for _, w := range ws {
+		if err := w.txn.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importDumpInBatches imports the BSON dump read from r using *nbWriters
+// writers whose transactions are committed every *batchSize documents, along
+// with a checkpoint, so that a failure only rolls back the current batch and
+// the import can be resumed from the last committed batch.
+//
+// Foreign key constraints that are not deferrable are left as they are, so
+// that no ALTER TABLE lock is held for the duration of the import.
+func (imp *importer) importDumpInBatches(r *dumpReader, cp *checkpoint, rep *dumpReport) error {
+	ws := make([]*writer, *nbWriters)
+	defer func() {
+		for _, w := range ws {
+			if w != nil {
+				w.txn.Rollback()
+			}
+		}
+	}()
+
+	begin := func() error {
+		for i := range ws {
+			txn, err := db.Begin()
+			if err != nil {
+				return err
+			}
+			w, err := imp.newWriter(txn, false)
+			if err != nil {
+				txn.Rollback()
+				return err
+			}
+			ws[i] = w
+		}
+		return nil
+	}
+
+	// commit closes and commits the writers, the first one, which records
+	// the checkpoint, being committed last so that the checkpoint is never
+	// ahead of the documents that have been committed.
+	commit := func(offset int64, completed bool) error {
+		if err := closeWriters(ws, rep, completed); err != nil {
+			return err
+		}
+		if err := cp.record(ws[0].txn, offset, completed); err != nil {
+			return err
+		}
+		for i := len(ws) - 1; i >= 0; i-- {
+			if err := ws[i].txn.Commit(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := begin(); err != nil {
+		return err
+	}
+	err := imp.run(r, rep, ws, func(offset int64) error {
+		if err := commit(offset, false); err != nil {
+			return err
+		}
+		printVerbose(rep.Name, ": committed up to offset ", offset)
+		return begin()
+	})
+	if err != nil {
+		return err
+	}
+	return commit(r.Offset(), true)
+}
+
+// origin returns the origin of the document d, read from the dump of rep.
+func (d *decodedDoc) origin(rep *dumpReport) origin {
+	return origin{dump: rep.Name, offset: d.offset, bs: d.bs}
+}
+
+// decodedDoc is a document of a dump going through the pipeline.
+type decodedDoc struct {
+	bs     []byte      // raw document
+	offset int64       // offset of the document within the dump
+	end    int64       // offset of the next document
+	doc    interface{} // decoded document
+	err    error       // why the document could not be read or decoded
+
+	// done is closed once the document has been decoded.
+	done chan struct{}
+}
+
+// run reads the documents of r, decodes them using a pool of *nbDecoders
+// decoders and dispatches them to the writers ws. When batch is not nil, it
+// is called every *batchSize documents, once the writers have written them,
+// with the offset following the last of them. It may replace the writers.
+//
+// Documents that cannot be read or decoded, as well as documents that cannot
+// be inserted, are logged and skipped. All of them are counted in rep. run
+// returns once all the documents have been written, or as soon as an error
+// occurs while reading the dump, the failed documents exceed their error
+// budget (see checkBudgets) or the run is aborted.
+func (imp *importer) run(r *dumpReader, rep *dumpReport, ws []*writer, batch func(offset int64) error) error {
+	nd := *nbDecoders
+	if nd < 1 {
+		nd = 1
+	}
+
+	// queue holds the documents in the order in which they are read, jobs
+	// holds the documents waiting to be decoded.
+	queue := make(chan *decodedDoc, 16*nd)
+	jobs := make(chan *decodedDoc, nd)
+	readErr := make(chan error, 1)
+
+	// stop is closed, with the reason in stopErr, to stop the import before
+	// all the documents have been read.
+	stop := make(chan struct{})
+	var (
+		stopOnce sync.Once
+		stopErr  error
+	)
+	halt := func(err error) {
+		stopOnce.Do(func() {
+			stopErr = err
+			close(stop)
+		})
+	}
+
+	go func() {
+		defer close(queue)
+		defer close(jobs)
+
+		for {
+			bs, err := r.ReadDoc()
+			if err == io.EOF {
+				readErr <- nil
+				return
+			}
+
+			d := &decodedDoc{bs: bs, offset: r.Offset() - int64(len(bs)), end: r.Offset(), done: make(chan struct{})}
+			if merr, ok := err.(*malformedDocError); ok {
+				d.offset = merr.Offset
+				d.err = err
+				close(d.done)
+			} else if err != nil {
+				readErr <- err
+				return
+			}
+
+			select {
+			case queue <- d:
+			case <-stop:
+				readErr <- nil
+				return
+			}
+			if d.err != nil {
+				continue
+			}
+			select {
+			case jobs <- d:
+			case <-stop:
+				readErr <- nil
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < nd; i++ {
+		go func() {
+			for d := range jobs {
+				d.doc, d.err = imp.decode(d.bs)
+				close(d.done)
+			}
+		}()
+	}
+
+	// pending counts the documents dispatched to the writers that have not
+	// been written yet.
+	var pending sync.WaitGroup
+
+	chans := make([]chan *decodedDoc, len(ws))
+	writersDone := make(chan struct{})
+	for i := range ws {
+		chans[i] = make(chan *decodedDoc, 64)
+		go func(i int, docs <-chan *decodedDoc) {
+			for d := range docs {
+				imp.write(ws[i], rep, d, stop, halt)
+				pending.Done()
+			}
+			writersDone <- struct{}{}
+		}(i, chans[i])
+	}
+
+	var next, n int
+dispatch:
+	for d := range queue {
+		if aborted() {
+			halt(errRunAborted)
+		}
+		select {
+		case <-d.done:
+		case <-stop:
+			break dispatch
+		}
+
+		rep.read()
+		if d.err != nil {
+			fail(rep.Name, ": ", d.err)
+			if err := reject(rep, d, d.err); err != nil {
+				halt(err)
+			}
+		} else {
+			var i int
+			switch {
+			case len(ws) == 1:
+			case imp.key == nil:
+				i = next
+				next = (next + 1) % len(ws)
+			default:
+				h := fnv.New32a()
+				h.Write([]byte(imp.key(d.doc)))
+				i = int(h.Sum32() % uint32(len(ws)))
+			}
+			pending.Add(1)
+			chans[i] <- d
+		}
+
+		n++
+		if batch == nil || n%*batchSize != 0 {
+			continue
+		}
+		pending.Wait()
+		select {
+		case <-stop:
+			break dispatch
+		default:
+		}
+		if err := batch(d.end); err != nil {
+			halt(err)
+			break dispatch
+		}
+	}
+
+	for _, c := range chans {
+		close(c)
+	}
+	for range ws {
+		<-writersDone
+	}
+
+	if err := <-readErr; err != nil {
+		return err
+	}
+	if stopErr != nil {
+		return stopErr
+	}
+	return checkBudgets(rep, true)
+}
+
+// write inserts the document d using the writer w, unless the import has been
+// stopped, and counts it in rep.
+func (imp *importer) write(w *writer, rep *dumpReport, d *decodedDoc, stop <-chan struct{}, halt func(error)) {
+	select {
+	case <-stop:
+		return
+	default:
+	}
+
+	if err := w.add(rep, d); err != nil {
+		halt(err)
+	}
+}
+
+// reject counts the document d, rejected because of err, in rep and writes it
+// to the dead-letter file. It returns an error if the failed documents exceed
+// their error budget.
+func reject(rep *dumpReport, d *decodedDoc, err error) error {
+	rep.failed(err, d.err == nil)
+	writeDeadLetter(rep.entity, rep.Name, d.offset, d.bs, err)
+	return checkBudgets(rep, false)
+}
+
+// docsPerSavepoint is the number of documents a writer inserts within the
+// same savepoint (see writer.add).
+const docsPerSavepoint = 100
+
+// writer writes documents into the database using its own transaction.
+type writer struct {
+	imp      *importer
+	txn      *sql.Tx
+	stmts    []*sql.Stmt
+	deferred *deferredConstraints
+	staged   int64 // documents copied by the writer
+
+	// group are the documents inserted within the current savepoint, which
+	// are only counted once it is released.
+	group []groupedDoc
+}
+
+// groupedDoc is a document inserted within the current savepoint of a writer,
+// along with the error returned by the importer, either nil or
+// errAlreadyExists.
+type groupedDoc struct {
+	d   *decodedDoc
+	err error
+}
+
+// newWriter creates a writer that defers the foreign key constraints of the
+// tables written by the importer and prepares its queries within txn. alter
+// tells whether constraints that are not deferrable are made deferrable (see
+// deferConstraints).
+func (imp *importer) newWriter(txn *sql.Tx, alter bool) (*writer, error) {
+	dc, err := deferConstraints(txn, imp.constrained, alter)
+	if err != nil {
+		return nil, err
+	}
+	if err := execAll(txn, imp.setup); err != nil {
+		return nil, err
+	}
+
+	w := &writer{imp: imp, txn: txn, deferred: dc}
+	for _, q := range imp.queries {
+		stmt, err := txn.Prepare(q)
+		if err != nil {
+			return nil, err
+		}
+		w.stmts = append(w.stmts, stmt)
+	}
+	return w, nil
+}
+
+// add inserts the document d and counts it in rep once it is written.
+//
+// Documents are inserted within savepoints, which are rolled back if an
+// insertion fails: PostgreSQL rejects all the statements of a transaction
+// following a failed one, so a single bad document would otherwise make all
+// the following ones fail. To save the round-trips of a savepoint per
+// document, documents are inserted in groups of docsPerSavepoint documents
+// sharing the same savepoint, which is released once the deferred constraints
+// have been checked (see flush). If a document of the group fails to be
+// inserted, or the constraints fail to be checked, the savepoint is rolled
+// back and the documents of the group are inserted again one by one (see
+// replay), so that only the failing ones are rejected. Documents copied using
+// COPY do not need any savepoint since they are only sent once all of them
+// have been copied.
+//
+// It returns an error if the transaction cannot be used anymore or if the
+// failed documents exceed their error budget.
+func (w *writer) add(rep *dumpReport, d *decodedDoc) error {
+	if w.imp.copyIn {
+		return w.count(rep, d, w.imp.insert(w.txn, w.stmts, d.doc, d.origin(rep)))
+	}
+
+	if len(w.group) == 0 {
+		if _, err := w.txn.Exec("SAVEPOINT ght2dm_group"); err != nil {
+			return err
+		}
+	}
+	err := w.imp.insert(w.txn, w.stmts, d.doc, d.origin(rep))
+	w.group = append(w.group, groupedDoc{d: d, err: err})
+	if err != nil && err != errAlreadyExists {
+		return w.replay(rep)
+	}
+	if len(w.group) < docsPerSavepoint {
+		return nil
+	}
+	return w.flush(rep)
+}
+
+// flush checks the deferred constraints and releases the savepoint of the
+// current group of documents, which are then counted in rep. The group is
+// replayed if the constraints fail to be checked.
+func (w *writer) flush(rep *dumpReport) error {
+	if len(w.group) == 0 {
+		return nil
+	}
+	if _, err := w.txn.Exec(w.deferred.checks() + "RELEASE SAVEPOINT ght2dm_group"); err != nil {
+		return w.replay(rep)
+	}
+
+	for _, g := range w.group {
+		rep.inserted(g.err)
+	}
+	w.group = w.group[:0]
+	return nil
+}
+
+// replay rolls back the savepoint of the current group of documents and
+// inserts them again one by one, counting them in rep.
+func (w *writer) replay(rep *dumpReport) error {
+	group := w.group
+	w.group = nil
+
+	if _, err := w.txn.Exec("ROLLBACK TO SAVEPOINT ght2dm_group; RELEASE SAVEPOINT ght2dm_group"); err != nil {
+		return err
+	}
+	for _, g := range group {
+		err, txnErr := w.insert(rep, g.d)
+		if txnErr != nil {
+			return txnErr
+		}
+		if err := w.count(rep, g.d, err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// count counts the document d, whose insertion returned err, in rep and
+// rejects it if it failed. It returns an error if the failed documents exceed
+// their error budget.
+func (w *writer) count(rep *dumpReport, d *decodedDoc, err error) error {
+	if err != nil && err != errAlreadyExists {
+		fail(err)
+		return reject(rep, d, err)
+	}
+	if w.imp.copyIn && err == nil {
+		w.staged++
+		rep.staged()
+		return nil
+	}
+	rep.inserted(err)
+	return nil
+}
+
+// insert inserts the document d within its own savepoint, which is rolled
+// back if the insertion fails. The deferred constraints are checked before
+// the savepoint is released, so that a document referring to a missing row is
+// rolled back alone.
+//
+// err is the error returned by the importer, txnErr is not nil if the
+// savepoint could not be created or rolled back, in which case the
+// transaction cannot be used anymore.
+func (w *writer) insert(rep *dumpReport, d *decodedDoc) (err, txnErr error) {
+	if _, err := w.txn.Exec("SAVEPOINT ght2dm_doc"); err != nil {
+		return nil, err
+	}
+	if err = w.imp.insert(w.txn, w.stmts, d.doc, d.origin(rep)); err == nil || err == errAlreadyExists {
+		_, cerr := w.txn.Exec(w.deferred.checks() + "RELEASE SAVEPOINT ght2dm_doc")
+		if cerr == nil {
+			return err, nil
+		}
+		err = cerr
+	}
+
+	// The savepoint is released once rolled back, so that savepoints do not
+	// pile up within the transaction.
+	if _, txnErr := w.txn.Exec("ROLLBACK TO SAVEPOINT ght2dm_doc; RELEASE SAVEPOINT ght2dm_doc"); txnErr != nil {
+		return err, txnErr
+	}
+	return err, nil
+}
+
+// closeWriters flushes and closes the writers ws, counts the documents they
+// inserted and merged in rep and checks the failed documents against their error budgets, so that the
+// transactions of the writers are not committed when the documents that
+// failed to be merged exceed them. final tells whether all the documents of
+// the dump have been written.
+func closeWriters(ws []*writer, rep *dumpReport, final bool) error {
+	for _, w := range ws {
+		if err := w.flush(rep); err != nil {
+			return err
+		}
+		mc, err := w.close(rep)
+		if err != nil {
+			return err
+		}
+		rep.merged(mc)
+	}
+	return checkBudgets(rep, final)
+}
+
+// close flushes and closes the statements of the writer, executes the
+// refresh and merge statements of the importer and checks the deferred
+// constraints. It does not commit its transaction.
+//
+// It returns the counts of the documents copied by the writer and merged by
+// the importer, the documents of rep failing to be merged being written to
+// the dead-letter file. Documents copied into a staging table merged once all
+// the dumps of the entity are imported (see staging) are not counted here.
+func (w *writer) close(rep *dumpReport) (mergeCounts, error) {
+	var mc mergeCounts
+	if w.imp.copyIn {
+		for _, stmt := range w.stmts {
+			if _, err := stmt.Exec(); err != nil {
+				return mc, err
+			}
+		}
+	}
+	for _, stmt := range w.stmts {
+		if err := stmt.Close(); err != nil {
+			return mc, err
+		}
+	}
+	var refreshed int64
+	if *update {
+		for _, stmt := range w.imp.refresh {
+			n, err := execCount(w.txn, stmt)
+			if err != nil {
+				return mc, err
+			}
+			refreshed += n
+		}
+	}
+	if len(w.imp.merge) > 0 {
+		var err error
+		if mc, err = w.merge(rep); err != nil {
+			return mc, err
+		}
+		mc.refreshed = refreshed
+	}
+	return mc, w.deferred.restore(w.txn)
+}
+
+// merge executes the merge statements of the importer and counts the rows
+// they inserted. The rows of the documents of rep that fail to be merged are
+// written to the dead-letter file.
+func (w *writer) merge(rep *dumpReport) (mergeCounts, error) {
+	mc := mergeCounts{staged: w.staged}
+	if w.imp.unresolved != "" {
+		var err error
+		if mc.unresolved, err = deadLetterRows(w.txn, rep.entity, w.imp.unresolved); err != nil {
+			return mc, err
+		}
+	}
+	for i, stmt := range w.imp.merge {
+		n, err := execCount(w.txn, stmt)
+		if err != nil {
+			return mc, err
+		}
+		if i >= w.imp.uncounted {
+			mc.merged += n
+		}
+	}
+	return mc, nil
+}
+
+// execCount executes the given statement within txn and returns the number
+// of rows it affected.
+func execCount(txn *sql.Tx, stmt string) (int64, error) {
+	res, err := txn.Exec(stmt)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// execAll executes the given statements within txn.
+func execAll(txn *sql.Tx, stmts []string) error {
+	for _, stmt := range stmts {
+		if _, err := txn.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,323 @@
+// Copyright 2014 The DevMine Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// fakeDB is a database/sql driver simulating the parts of PostgreSQL writers
+// rely on, for a single children table whose parent_id column refers to a set
+// of existing parents through a deferrable foreign key: savepoints,
+// transactions aborted by a failed statement and deferred constraints.
+type fakeDB struct {
+	mu        sync.Mutex
+	parents   map[int64]bool
+	committed []int64 // parent_id of the committed children
+
+	// execs counts the statements executed, by their first word.
+	execs map[string]int
+
+	// unresolved are the rows returned by the queries of the origin of
+	// unresolved rows.
+	unresolved [][]driver.Value
+}
+
+func (db *fakeDB) Open(name string) (driver.Conn, error) {
+	return &fakeConn{db: db}, nil
+}
+
+// fakeConn is a connection to a fakeDB.
+type fakeConn struct {
+	db         *fakeDB
+	rows       []int64 // parent_id of the children inserted by the transaction
+	savepoints map[string]int
+	deferred   bool
+	aborted    bool
+}
+
+// fakeFKName is the name of the foreign key of the children table.
+const fakeFKName = "children_parent_id_fkey"
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{c: c, query: query}, nil
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	c.rows, c.savepoints, c.deferred, c.aborted = nil, make(map[string]int), false, false
+	return c, nil
+}
+
+func (c *fakeConn) Commit() error {
+	if c.aborted {
+		return errors.New("current transaction is aborted")
+	}
+	if err := c.check(); err != nil {
+		return err
+	}
+	c.db.mu.Lock()
+	c.db.committed = append(c.db.committed, c.rows...)
+	c.db.mu.Unlock()
+	return nil
+}
+
+func (c *fakeConn) Rollback() error { return nil }
+
+// check checks the foreign key of the children inserted by the transaction.
+func (c *fakeConn) check() error {
+	for _, id := range c.rows {
+		if !c.db.parents[id] {
+			return fmt.Errorf("insert or update on table children violates foreign key constraint %s", fakeFKName)
+		}
+	}
+	return nil
+}
+
+// exec executes a single statement.
+func (c *fakeConn) exec(query string, args []driver.Value) error {
+	query = strings.TrimSpace(query)
+	fields := strings.Fields(query)
+
+	c.db.mu.Lock()
+	c.db.execs[fields[0]]++
+	c.db.mu.Unlock()
+
+	if c.aborted && !strings.HasPrefix(query, "ROLLBACK TO SAVEPOINT ") {
+		return errors.New("current transaction is aborted")
+	}
+	err := c.execValid(query, fields, args)
+	if err != nil {
+		c.aborted = true
+	}
+	return err
+}
+
+func (c *fakeConn) execValid(query string, fields []string, args []driver.Value) error {
+	switch {
+	case strings.HasPrefix(query, "SAVEPOINT "):
+		c.savepoints[fields[1]] = len(c.rows)
+	case strings.HasPrefix(query, "ROLLBACK TO SAVEPOINT "):
+		n, ok := c.savepoints[fields[3]]
+		if !ok {
+			return fmt.Errorf("savepoint %s does not exist", fields[3])
+		}
+		c.rows, c.aborted = c.rows[:n], false
+	case strings.HasPrefix(query, "RELEASE SAVEPOINT "):
+		if _, ok := c.savepoints[fields[2]]; !ok {
+			return fmt.Errorf("savepoint %s does not exist", fields[2])
+		}
+		delete(c.savepoints, fields[2])
+	case strings.HasPrefix(query, "SET CONSTRAINTS "):
+		c.deferred = fields[len(fields)-1] == "DEFERRED"
+		if !c.deferred {
+			return c.check()
+		}
+	case strings.HasPrefix(query, "INSERT INTO children"):
+		id := args[0].(int64)
+		if !c.deferred && !c.db.parents[id] {
+			return fmt.Errorf("insert or update on table children violates foreign key constraint %s", fakeFKName)
+		}
+		c.rows = append(c.rows, id)
+	default:
+		return fmt.Errorf("unexpected statement %q", query)
+	}
+	return nil
+}
+
+// fakeStmt is a statement of a fakeConn. Statements without arguments may
+// hold several statements separated by semicolons, as with lib/pq.
+type fakeStmt struct {
+	c     *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	for _, q := range strings.Split(s.query, ";") {
+		if strings.TrimSpace(q) == "" {
+			continue
+		}
+		if err := s.c.exec(q, args); err != nil {
+			return nil, err
+		}
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	switch {
+	case strings.Contains(s.query, "pg_constraint"):
+		return &fakeRows{
+			columns: []string{"relname", "conname", "condeferrable"},
+			values:  [][]driver.Value{{"children", fakeFKName, true}},
+		}, nil
+	case strings.Contains(s.query, "dump_offset"):
+		return &fakeRows{
+			columns: []string{"dump_name", "dump_offset", "document"},
+			values:  s.c.db.unresolved,
+		}, nil
+	}
+	return nil, fmt.Errorf("unexpected query %q", s.query)
+}
+
+// fakeRows are the rows returned by a fakeStmt.
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+// fakeConnector opens connections to a fakeDB.
+type fakeConnector struct {
+	db *fakeDB
+}
+
+func (c fakeConnector) Connect(context.Context) (driver.Conn, error) { return c.db.Open("") }
+func (c fakeConnector) Driver() driver.Driver                        { return c.db }
+
+// childrenImporter imports documents made of the id of the parent of a child.
+var childrenImporter = &importer{
+	constrained: []string{"children"},
+	queries:     []string{"INSERT INTO children(parent_id) VALUES ($1)"},
+	decode: func(bs []byte) (interface{}, error) {
+		var doc struct {
+			Parent int64 `bson:"parent"`
+		}
+		err := bson.Unmarshal(bs, &doc)
+		return doc.Parent, err
+	},
+	insert: func(txn *sql.Tx, stmts []*sql.Stmt, doc interface{}, o origin) error {
+		if doc.(int64) == 0 {
+			return errors.New("impossible to insert child without parent")
+		}
+		_, err := stmts[0].Exec(doc)
+		return err
+	},
+}
+
+// withFakeDB sets db to a new fakeDB whose parents are the given ids for the
+// duration of f.
+func withFakeDB(t *testing.T, parents []int64, f func(fdb *fakeDB)) {
+	fdb := &fakeDB{parents: make(map[int64]bool), execs: make(map[string]int)}
+	for _, id := range parents {
+		fdb.parents[id] = true
+	}
+
+	defer func(orig *sql.DB) { db = orig }(db)
+	db = sql.OpenDB(fakeConnector{fdb})
+	defer db.Close()
+
+	f(fdb)
+}
+
+// childrenDump returns a dump of children of the given parents.
+func childrenDump(t *testing.T, parents ...int64) io.Reader {
+	var buf bytes.Buffer
+	for _, id := range parents {
+		buf.Write(marshalDoc(t, bson.M{"parent": id}))
+	}
+	return &buf
+}
+
+func TestImportDumpOrphan(t *testing.T) {
+	withFakeDB(t, []int64{1, 3}, func(fdb *fakeDB) {
+		rr := &runReport{Entities: make(map[string]*entityReport)}
+		rep := rr.startDump("children", "children.bson")
+
+		if err := childrenImporter.importDump(childrenDump(t, 1, 2, 3), nil, rep); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// Only the child of the missing parent is lost.
+		if want := []int64{1, 3}; !reflect.DeepEqual(fdb.committed, want) {
+			t.Errorf("got children of %v committed, want %v", fdb.committed, want)
+		}
+		if rep.Inserted != 2 || rep.Failed != 1 {
+			t.Errorf("got %d documents inserted and %d failed, want 2 and 1", rep.Inserted, rep.Failed)
+		}
+	})
+}
+
+func TestImportDumpSavepointGroups(t *testing.T) {
+	parents := make([]int64, 2*docsPerSavepoint+docsPerSavepoint/2)
+	for i := range parents {
+		parents[i] = int64(i + 1)
+	}
+
+	withFakeDB(t, parents, func(fdb *fakeDB) {
+		rr := &runReport{Entities: make(map[string]*entityReport)}
+		rep := rr.startDump("children", "children.bson")
+
+		if err := childrenImporter.importDump(childrenDump(t, parents...), nil, rep); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(fdb.committed, parents) {
+			t.Errorf("got %d children committed, want %d", len(fdb.committed), len(parents))
+		}
+		if rep.Inserted != int64(len(parents)) {
+			t.Errorf("got %d documents inserted, want %d", rep.Inserted, len(parents))
+		}
+		// One savepoint per group of documents.
+		if got := fdb.execs["SAVEPOINT"]; got != 3 {
+			t.Errorf("got %d savepoints, want 3", got)
+		}
+	})
+}
+
+func TestImportDumpReplay(t *testing.T) {
+	withFakeDB(t, []int64{1, 2, 3, 4}, func(fdb *fakeDB) {
+		rr := &runReport{Entities: make(map[string]*entityReport)}
+		rep := rr.startDump("children", "children.bson")
+
+		// The child without parent fails within the first group, which is
+		// replayed one document at a time, while the second group is
+		// inserted as a whole.
+		dump := []int64{1, 2, 0, 3}
+		for len(dump) < docsPerSavepoint+2 {
+			dump = append(dump, 4)
+		}
+		if err := childrenImporter.importDump(childrenDump(t, dump...), nil, rep); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		want := append([]int64{1, 2}, dump[3:]...)
+		if !reflect.DeepEqual(fdb.committed, want) {
+			t.Errorf("got children of %v committed, want %v", fdb.committed, want)
+		}
+		if rep.Inserted != int64(len(want)) || rep.Failed != 1 {
+			t.Errorf("got %d documents inserted and %d failed, want %d and 1", rep.Inserted, rep.Failed, len(want))
+		}
+		if got, want := fdb.execs["SAVEPOINT"], 2+3; got != want {
+			t.Errorf("got %d savepoints, want %d", got, want)
+		}
+	})
+}
@@ -0,0 +1,274 @@
+// Copyright 2014 The DevMine Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+
+	"labix.org/v2/mgo/bson"
+)
+
+type (
+	// ghPullRequest represents a pull request of a GitHub repository.
+	ghPullRequest struct {
+		ID        int64  `bson:"id"`
+		Number    int64  `bson:"number"`
+		Title     string `bson:"title"`
+		Body      string `bson:"body"`
+		State     string `bson:"state"` // open or closed
+		Merged    bool   `bson:"merged"`
+		MergedAt  string `bson:"merged_at"`
+		CreatedAt string `bson:"created_at"`
+		UpdatedAt string `bson:"updated_at"`
+		ClosedAt  string `bson:"closed_at"`
+
+		// Repository the pull request was opened against
+		Owner string `bson:"owner"`
+		Repo  string `bson:"repo"`
+
+		// Author of the pull request
+		User struct {
+			Login string `bson:"login"`
+		} `bson:"user"`
+
+		Head ghPullRequestRef `bson:"head"` // branch containing the changes
+		Base ghPullRequestRef `bson:"base"` // branch the changes are pulled into
+	}
+
+	// ghPullRequestRef is the head or the base branch of a pull request.
+	ghPullRequestRef struct {
+		Ref string `bson:"ref"` // name of the branch
+		SHA string `bson:"sha"`
+
+		// Repository of the branch. It is empty when the repository has been
+		// deleted.
+		Repo struct {
+			FullName string `bson:"full_name"`
+		} `bson:"repo"`
+	}
+
+	// ghPullRequestComment represents a review comment on a GitHub pull
+	// request.
+	ghPullRequestComment struct {
+		ID        int64  `bson:"id"`
+		PullReqID int64  `bson:"pullreq_id"` // number of the pull request
+		Body      string `bson:"body"`
+		Path      string `bson:"path"` // file the comment applies to
+		Position  int64  `bson:"position"`
+		CommitID  string `bson:"commit_id"`
+		CreatedAt string `bson:"created_at"`
+		UpdatedAt string `bson:"updated_at"`
+
+		// Repository of the pull request
+		Owner string `bson:"owner"`
+		Repo  string `bson:"repo"`
+
+		// Author of the comment
+		User struct {
+			Login string `bson:"login"`
+		} `bson:"user"`
+	}
+)
+
+// Tables fields
+var (
+	pullRequestsFields = []string{
+		"repository_id",
+		"head_repository_id",
+		"gh_user_id",
+		"github_id",
+		"number",
+		"title",
+		"body",
+		"state",
+		"merged",
+		"merged_at",
+		"head_ref",
+		"head_sha",
+		"base_ref",
+		"base_sha",
+		"created_at",
+		"updated_at",
+		"closed_at",
+	}
+	pullRequestCommentsFields = []string{
+		"gh_pull_request_id",
+		"gh_user_id",
+		"github_id",
+		"body",
+		"path",
+		"position",
+		"commit_id",
+		"created_at",
+		"updated_at",
+	}
+)
+
+// pullRequestsImporter imports BSON dumps containing GitHub pull requests into
+// the DevMine database.
+var pullRequestsImporter = &importer{
+	constrained: []string{"gh_pull_requests"},
+	queries:     []string{genInsQuery("gh_pull_requests", pullRequestsFields...)},
+	decode: func(bs []byte) (interface{}, error) {
+		ghpr := ghPullRequest{}
+		err := bson.Unmarshal(bs, &ghpr)
+		return ghpr, err
+	},
+	key: func(doc interface{}) string {
+		return strconv.FormatInt(doc.(ghPullRequest).ID, 10)
+	},
+	insert: func(txn *sql.Tx, stmts []*sql.Stmt, doc interface{}, o origin) error {
+		ghpr := doc.(ghPullRequest)
+		printVerbose("importing pull request", ghpr.Number, "of", ghpr.Owner+"/"+ghpr.Repo)
+		return insertPullRequest(txn, stmts[0], ghpr)
+	},
+}
+
+// insertPullRequest inserts a GitHub pull request into the database.
+func insertPullRequest(txn *sql.Tx, stmt *sql.Stmt, ghpr ghPullRequest) error {
+	if !*nocheck {
+		if id := fetchIDFromGithubID(txn, "gh_pull_requests", ghpr.ID); id != 0 {
+			if id == -1 {
+				return fmt.Errorf("impossible to insert pull request with github_id %d", ghpr.ID)
+			}
+			return errAlreadyExists
+		}
+	}
+
+	fullname := ghpr.Base.Repo.FullName
+	if fullname == "" {
+		fullname = ghpr.Owner + "/" + ghpr.Repo
+	}
+	repoID := fetchRepoIDFromFullname(txn, fullname)
+	if repoID <= 0 {
+		return fmt.Errorf("failed to retrieve the id of the repository having the full name %s", fullname)
+	}
+
+	// The head repository is usually a fork, which may have been deleted or
+	// not imported, in which case the pull request is not linked to it.
+	var headRepoID *int64
+	if ghpr.Head.Repo.FullName != "" {
+		if id := fetchRepoIDFromFullname(txn, ghpr.Head.Repo.FullName); id > 0 {
+			headRepoID = &id
+		}
+	}
+
+	ghUserID := fetchGhUserIDFromLogin(txn, ghpr.User.Login)
+	if ghUserID <= 0 {
+		return fmt.Errorf("failed to retrieve the id of the github user having the login %s", ghpr.User.Login)
+	}
+
+	_, err := stmt.Exec(
+		repoID,
+		headRepoID,
+		ghUserID,
+		ghpr.ID,
+		ghpr.Number,
+		removeNullByte(ghpr.Title),
+		removeNullByte(ghpr.Body),
+		ghpr.State,
+		ghpr.Merged,
+		nullIfEmpty(ghpr.MergedAt),
+		removeNullByte(ghpr.Head.Ref),
+		ghpr.Head.SHA,
+		removeNullByte(ghpr.Base.Ref),
+		ghpr.Base.SHA,
+		nullIfEmpty(ghpr.CreatedAt),
+		nullIfEmpty(ghpr.UpdatedAt),
+		nullIfEmpty(ghpr.ClosedAt))
+	if err != nil {
+		fail(err)
+		return fmt.Errorf("impossible to insert pull request with github_id %d", ghpr.ID)
+	}
+	return nil
+}
+
+// pullRequestCommentsImporter imports BSON dumps containing review comments on
+// GitHub pull requests into the DevMine database.
+var pullRequestCommentsImporter = &importer{
+	constrained: []string{"gh_pull_request_comments"},
+	queries:     []string{genInsQuery("gh_pull_request_comments", pullRequestCommentsFields...)},
+	decode: func(bs []byte) (interface{}, error) {
+		ghprc := ghPullRequestComment{}
+		err := bson.Unmarshal(bs, &ghprc)
+		return ghprc, err
+	},
+	key: func(doc interface{}) string {
+		return strconv.FormatInt(doc.(ghPullRequestComment).ID, 10)
+	},
+	insert: func(txn *sql.Tx, stmts []*sql.Stmt, doc interface{}, o origin) error {
+		ghprc := doc.(ghPullRequestComment)
+		printVerbose("importing comment", ghprc.ID, "of pull request", ghprc.PullReqID, "of", ghprc.Owner+"/"+ghprc.Repo)
+		return insertPullRequestComment(txn, stmts[0], ghprc)
+	},
+}
+
+// insertPullRequestComment inserts a review comment on a GitHub pull request
+// into the database.
+func insertPullRequestComment(txn *sql.Tx, stmt *sql.Stmt, ghprc ghPullRequestComment) error {
+	if !*nocheck {
+		if id := fetchIDFromGithubID(txn, "gh_pull_request_comments", ghprc.ID); id != 0 {
+			if id == -1 {
+				return fmt.Errorf("impossible to insert pull request comment with github_id %d", ghprc.ID)
+			}
+			return errAlreadyExists
+		}
+	}
+
+	fullname := ghprc.Owner + "/" + ghprc.Repo
+	pullRequestID := fetchPullRequestID(txn, fullname, ghprc.PullReqID)
+	if pullRequestID <= 0 {
+		return fmt.Errorf("failed to retrieve the id of the pull request %d of %s", ghprc.PullReqID, fullname)
+	}
+
+	ghUserID := fetchGhUserIDFromLogin(txn, ghprc.User.Login)
+	if ghUserID <= 0 {
+		return fmt.Errorf("failed to retrieve the id of the github user having the login %s", ghprc.User.Login)
+	}
+
+	_, err := stmt.Exec(
+		pullRequestID,
+		ghUserID,
+		ghprc.ID,
+		removeNullByte(ghprc.Body),
+		removeNullByte(ghprc.Path),
+		ghprc.Position,
+		nullIfEmpty(ghprc.CommitID),
+		nullIfEmpty(ghprc.CreatedAt),
+		nullIfEmpty(ghprc.UpdatedAt))
+	if err != nil {
+		fail(err)
+		return fmt.Errorf("impossible to insert pull request comment with github_id %d", ghprc.ID)
+	}
+	return nil
+}
+
+// fetchPullRequestIDQuery is the query of fetchPullRequestID.
+const fetchPullRequestIDQuery = `
+	SELECT gh_pull_requests.id
+	FROM gh_pull_requests
+	LEFT JOIN gh_repositories ON gh_repositories.repository_id = gh_pull_requests.repository_id
+	WHERE gh_repositories.full_name=$1 AND gh_pull_requests.number=$2`
+
+// fetchPullRequestID fetches the ID of the pull request having the given
+// number in the repository having the given full name.
+// It returns 0 if the pull request does not already exists in the database and
+// -1 if an error occured while processing the query.
+func fetchPullRequestID(txn *sql.Tx, fullname string, number int64) int64 {
+	var id int64
+	err := txn.QueryRow(fetchPullRequestIDQuery, fullname, number).Scan(&id)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return 0
+	case err != nil:
+		fail("failed to fetch pull request id: ", err)
+		return -1
+	}
+
+	return id
+}
@@ -0,0 +1,299 @@
+// Copyright 2014 The DevMine Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Status of the import of a dump
+const (
+	dumpImported = "imported"
+	dumpSkipped  = "skipped" // already imported by a previous run
+	dumpFailed   = "failed"
+)
+
+// runReport is the report of a run, written as JSON to the file given by the
+// -report option.
+type runReport struct {
+	Start    time.Time                `json:"start"`
+	End      time.Time                `json:"end"`
+	Duration float64                  `json:"duration_seconds"`
+	Entities map[string]*entityReport `json:"entities"`
+
+	mu sync.Mutex
+}
+
+// entityReport is the report of the imports of the dumps of a GitHub entity.
+// Its counts are the sums of the counts of its dumps.
+type entityReport struct {
+	documentCounts
+	Dumps []*dumpReport `json:"dumps"`
+
+	// MergeDuration is the time spent merging the staging table of the
+	// entity, if any, into the DevMine tables.
+	MergeDuration float64 `json:"merge_duration_seconds,omitempty"`
+
+	// merge holds the counts of the documents merged from the staging table
+	// of the entity, which are added to the counts of its dumps.
+	merge documentCounts
+
+	// run holds the counts checked against the error budget of the run.
+	run failureCounts
+}
+
+// dumpReport is the report of the import of a dump.
+type dumpReport struct {
+	Name     string    `json:"name"`
+	Status   string    `json:"status"`
+	Error    string    `json:"error,omitempty"`
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"duration_seconds"`
+	documentCounts
+
+	entity string
+	mu     sync.Mutex
+
+	// counts and runCounts hold the counts checked against the error budgets
+	// of the dump and of the run.
+	counts    failureCounts
+	runCounts *failureCounts
+}
+
+// documentCounts holds the number of documents read from dumps, and what
+// became of them. Documents copied into staging tables are counted as staged
+// until the staging tables are merged into the DevMine tables, and then as
+// inserted, refreshed, skipped or failed depending on the outcome of the
+// merge.
+type documentCounts struct {
+	Read      int64            `json:"read"`
+	Staged    int64            `json:"staged,omitempty"` // not merged yet
+	Inserted  int64            `json:"inserted"`
+	Refreshed int64            `json:"refreshed,omitempty"` // more recent than the database, in update mode
+	Skipped   int64            `json:"skipped"`             // already in the database
+	Failed    int64            `json:"failed"`
+	Failures  map[string]int64 `json:"failures,omitempty"` // failed documents by reason
+}
+
+// add adds the counts of o to c.
+func (c *documentCounts) add(o documentCounts) {
+	c.Read += o.Read
+	c.Staged += o.Staged
+	c.Inserted += o.Inserted
+	c.Refreshed += o.Refreshed
+	c.Skipped += o.Skipped
+	c.Failed += o.Failed
+	for reason, n := range o.Failures {
+		if c.Failures == nil {
+			c.Failures = make(map[string]int64)
+		}
+		c.Failures[reason] += n
+	}
+}
+
+// report is the report of the current run.
+var report = &runReport{
+	Start:    time.Now(),
+	Entities: make(map[string]*entityReport),
+}
+
+// startDump adds the report of the import of the dump named name, containing
+// documents of the given entity, to the report of the run and returns it.
+func (rr *runReport) startDump(entity, name string) *dumpReport {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	er := rr.entity(entity)
+	d := &dumpReport{Name: name, Start: time.Now(), entity: entity, runCounts: &er.run}
+	er.Dumps = append(er.Dumps, d)
+	return d
+}
+
+// merged records the time spent merging the staging table of the given
+// entity, and what became of the rows of the table.
+func (rr *runReport) merged(entity string, d time.Duration, mc mergeCounts) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	er := rr.entity(entity)
+	er.MergeDuration += d.Seconds()
+	er.merge.add(mc.documentCounts())
+	atomic.AddInt64(&er.run.insertFailed, mc.unresolved)
+}
+
+// runCounts returns the counts of the given entity checked against the error
+// budget of the run.
+func (rr *runReport) runCounts(entity string) *failureCounts {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	return &rr.entity(entity).run
+}
+
+// entity returns the report of the given entity. rr.mu must be held.
+func (rr *runReport) entity(entity string) *entityReport {
+	er, ok := rr.Entities[entity]
+	if !ok {
+		er = &entityReport{}
+		rr.Entities[entity] = er
+	}
+	return er
+}
+
+// write writes the report of the run as JSON to the file at path.
+func (rr *runReport) write(path string) error {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	rr.End = time.Now()
+	rr.Duration = rr.End.Sub(rr.Start).Seconds()
+	for _, er := range rr.Entities {
+		er.documentCounts = documentCounts{}
+		for _, d := range er.Dumps {
+			d.mu.Lock()
+			er.add(d.documentCounts)
+			d.mu.Unlock()
+		}
+		er.add(er.merge)
+	}
+
+	bs, err := json.MarshalIndent(rr, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(bs, '\n'), 0644)
+}
+
+// read counts a document read from the dump.
+func (d *dumpReport) read() {
+	d.mu.Lock()
+	d.Read++
+	d.mu.Unlock()
+
+	atomic.AddInt64(&d.counts.read, 1)
+	atomic.AddInt64(&d.runCounts.read, 1)
+}
+
+// inserted counts a document inserted into the database, or skipped if err is
+// errAlreadyExists.
+func (d *dumpReport) inserted(err error) {
+	d.mu.Lock()
+	if err == errAlreadyExists {
+		d.Skipped++
+	} else {
+		d.Inserted++
+	}
+	d.mu.Unlock()
+}
+
+// staged counts a document copied into a staging table.
+func (d *dumpReport) staged() {
+	d.mu.Lock()
+	d.Staged++
+	d.mu.Unlock()
+}
+
+// merged counts the documents of the dump merged from a staging table.
+func (d *dumpReport) merged(mc mergeCounts) {
+	d.mu.Lock()
+	d.add(mc.documentCounts())
+	d.mu.Unlock()
+
+	atomic.AddInt64(&d.counts.insertFailed, mc.unresolved)
+	atomic.AddInt64(&d.runCounts.insertFailed, mc.unresolved)
+}
+
+// failed counts a document that could not be read or decoded, or that could
+// not be inserted if insert is true, because of err.
+func (d *dumpReport) failed(err error, insert bool) {
+	d.mu.Lock()
+	d.Failed++
+	if d.Failures == nil {
+		d.Failures = make(map[string]int64)
+	}
+	d.Failures[failureReason(err)]++
+	d.mu.Unlock()
+
+	if insert {
+		atomic.AddInt64(&d.counts.insertFailed, 1)
+		atomic.AddInt64(&d.runCounts.insertFailed, 1)
+	} else {
+		atomic.AddInt64(&d.counts.readFailed, 1)
+		atomic.AddInt64(&d.runCounts.readFailed, 1)
+	}
+}
+
+// skip marks the dump as skipped because it has already been imported.
+func (d *dumpReport) skip() {
+	d.mu.Lock()
+	d.Status = dumpSkipped
+	d.mu.Unlock()
+}
+
+// finish marks the import of the dump as done, and failed if err is not nil.
+func (d *dumpReport) finish(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.Duration = time.Since(d.Start).Seconds()
+	if err != nil {
+		d.Status = dumpFailed
+		d.Error = err.Error()
+		return
+	}
+	d.Status = dumpImported
+}
+
+// errUnresolved is the reason of the failure of the staged documents that
+// refer to entities missing from the database when merged.
+var errUnresolved = errors.New("referenced github entity not found when merged")
+
+// mergeCounts holds the number of rows of a staging table merged into the
+// DevMine tables.
+type mergeCounts struct {
+	staged     int64 // rows of the staging table
+	merged     int64 // rows inserted into the DevMine tables
+	refreshed  int64 // rows refreshing the DevMine tables, in update mode
+	unresolved int64 // rows referring to entities missing from the database
+}
+
+// documentCounts returns the counts of the documents merged: the staged rows
+// that were neither inserted, refreshed nor unresolved are duplicates, or
+// already in the database, and thus skipped.
+func (mc mergeCounts) documentCounts() documentCounts {
+	c := documentCounts{
+		Staged:    -mc.staged,
+		Inserted:  mc.merged,
+		Refreshed: mc.refreshed,
+		Failed:    mc.unresolved,
+	}
+	if skipped := mc.staged - mc.merged - mc.refreshed - mc.unresolved; skipped > 0 {
+		c.Skipped = skipped
+	}
+	if mc.unresolved > 0 {
+		c.Failures = map[string]int64{errUnresolved.Error(): mc.unresolved}
+	}
+	return c
+}
+
+// failureIDRegexp matches the part of error messages identifying the document
+// that failed, such as "with github_id 42" or "42 of owner/repo".
+var failureIDRegexp = regexp.MustCompile(`\s+(with|having)\s.*$|\s+\S+ of \S+$`)
+
+// failureReason returns the reason of a document failure, which is the error
+// message without the identifier of the document, so that failures can be
+// grouped by reason.
+func failureReason(err error) string {
+	if merr, ok := err.(*malformedDocError); ok {
+		return "malformed bson document: " + merr.Reason
+	}
+	return failureIDRegexp.ReplaceAllString(err.Error(), "")
+}
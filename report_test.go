@@ -0,0 +1,167 @@
+// Copyright 2014 The DevMine Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFailureReason(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{
+			errors.New("impossible to insert github user with login = foo"),
+			"impossible to insert github user",
+		},
+		{
+			errors.New("impossible to insert tmp issue with github_id 42"),
+			"impossible to insert tmp issue",
+		},
+		{
+			errors.New("failed to retrieve the id of the github user having the login foo"),
+			"failed to retrieve the id of the github user",
+		},
+		{
+			errors.New("impossible to insert tmp follower foo of bar"),
+			"impossible to insert tmp follower",
+		},
+		{
+			errors.New("impossible to insert tmp watcher foo of owner/repo"),
+			"impossible to insert tmp watcher",
+		},
+		{
+			errors.New("impossible to find the repository of tmp commit with sha 6dcb09b"),
+			"impossible to find the repository of tmp commit",
+		},
+		{
+			errors.New("impossible to insert tmp commit without sha"),
+			"impossible to insert tmp commit without sha",
+		},
+		{errAlreadyExists, errAlreadyExists.Error()},
+		{errUnresolved, errUnresolved.Error()},
+		{
+			&malformedDocError{Offset: 1234, Reason: "missing document terminator"},
+			"malformed bson document: missing document terminator",
+		},
+	}
+	for _, tt := range tests {
+		if got := failureReason(tt.err); got != tt.want {
+			t.Errorf("failureReason(%q) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestMergeCounts(t *testing.T) {
+	tests := []struct {
+		mc   mergeCounts
+		want documentCounts
+	}{
+		{mergeCounts{}, documentCounts{}},
+		{
+			mergeCounts{staged: 10, merged: 10},
+			documentCounts{Staged: -10, Inserted: 10},
+		},
+		{
+			mergeCounts{staged: 10, merged: 6, unresolved: 3},
+			documentCounts{
+				Staged:   -10,
+				Inserted: 6,
+				Skipped:  1,
+				Failed:   3,
+				Failures: map[string]int64{errUnresolved.Error(): 3},
+			},
+		},
+		{
+			mergeCounts{staged: 10, merged: 2, refreshed: 5},
+			documentCounts{Staged: -10, Inserted: 2, Refreshed: 5, Skipped: 3},
+		},
+		{
+			mergeCounts{staged: 10, unresolved: 10},
+			documentCounts{
+				Staged:   -10,
+				Failed:   10,
+				Failures: map[string]int64{errUnresolved.Error(): 10},
+			},
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.mc.documentCounts(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("counts of %+v = %+v, want %+v", tt.mc, got, tt.want)
+		}
+	}
+}
+
+func TestDumpReportMerged(t *testing.T) {
+	rr := &runReport{Entities: make(map[string]*entityReport)}
+	d := rr.startDump(ghOrgMembers, "2014-01-01.bson")
+
+	for i := 0; i < 5; i++ {
+		d.read()
+		d.staged()
+	}
+	d.merged(mergeCounts{staged: 5, merged: 2, unresolved: 2})
+
+	want := documentCounts{
+		Read:     5,
+		Inserted: 2,
+		Skipped:  1,
+		Failed:   2,
+		Failures: map[string]int64{errUnresolved.Error(): 2},
+	}
+	if !reflect.DeepEqual(d.documentCounts, want) {
+		t.Errorf("got counts %+v, want %+v", d.documentCounts, want)
+	}
+
+	// Unresolved documents are checked against the error budgets.
+	if c := d.counts.load(); c.insertFailed != 2 {
+		t.Errorf("got %d documents failed to be inserted in the dump, want 2", c.insertFailed)
+	}
+	if c := rr.runCounts(ghOrgMembers).load(); c.insertFailed != 2 {
+		t.Errorf("got %d documents failed to be inserted in the run, want 2", c.insertFailed)
+	}
+}
+
+func TestRunReportMerged(t *testing.T) {
+	rr := &runReport{Entities: make(map[string]*entityReport)}
+	d := rr.startDump(ghCommits, "2014-01-01.bson")
+	for i := 0; i < 4; i++ {
+		d.read()
+		d.staged()
+	}
+
+	// The rows of the staging table are merged once for all the dumps of the
+	// entity, so the dumps keep their staged documents.
+	rr.merged(ghCommits, 0, mergeCounts{staged: 4, merged: 3, unresolved: 1})
+
+	dir, err := ioutil.TempDir("", "ght2dm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := rr.write(filepath.Join(dir, "report.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	er := rr.Entities[ghCommits]
+	want := documentCounts{
+		Read:     4,
+		Inserted: 3,
+		Failed:   1,
+		Failures: map[string]int64{errUnresolved.Error(): 1},
+	}
+	if !reflect.DeepEqual(er.documentCounts, want) {
+		t.Errorf("got counts %+v, want %+v", er.documentCounts, want)
+	}
+	if d.Staged != 4 {
+		t.Errorf("got %d documents staged in the dump, want 4", d.Staged)
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2014 The DevMine Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "sync"
+
+// dependencies maps each GitHub entity to the entities it refers to, which
+// must be imported before it.
+var dependencies = map[string][]string{
+	ghCommits:           {ghUsers, ghRepos},
+	ghOrgMembers:        {ghUsers},
+	ghFollowers:         {ghUsers},
+	ghRepoCollaborators: {ghUsers, ghRepos},
+	ghWatchers:          {ghUsers, ghRepos},
+	ghIssues:            {ghUsers, ghRepos},
+	ghIssueComments:     {ghUsers, ghIssues},
+	ghIssueEvents:       {ghUsers, ghIssues},
+	ghPullRequests:      {ghUsers, ghRepos},
+	ghPullReqComments:   {ghUsers, ghPullRequests},
+}
+
+// scheduler runs the imports of BSON dumps concurrently, up to a maximum number
+// of concurrent imports, while making sure that an entity is only imported
+// once all the dumps of the entities it depends on have been imported.
+//
+// The dumps of an entity are imported one after the other, in the order in
+// which they were added, unless the default importer of the entity only
+// copies its documents into a staging table that is merged after the import
+// (see importer.copyIn), in which case its dumps are imported concurrently.
+//
+// Once the run is aborted (see importFailed), the imports and the finalizers
+// that have not started yet are skipped.
+type scheduler struct {
+	tasks map[string][]func()
+	sem   chan struct{}
+
+	// finalizers are run once all the dumps of an entity are imported,
+	// before the entities depending on it are imported.
+	finalizers map[string][]func()
+}
+
+// newScheduler creates a scheduler running at most maxJobs imports at a time.
+func newScheduler(maxJobs int) *scheduler {
+	if maxJobs < 1 {
+		maxJobs = 1
+	}
+	return &scheduler{
+		tasks:      make(map[string][]func()),
+		sem:        make(chan struct{}, maxJobs),
+		finalizers: make(map[string][]func()),
+	}
+}
+
+// add schedules the import of a dump of the given entity. The task must take
+// care of logging its own errors.
+func (s *scheduler) add(entity string, task func()) {
+	s.tasks[entity] = append(s.tasks[entity], task)
+}
+
+// after schedules fn to be run once all the dumps of the given entity are
+// imported. fn must take care of logging its own errors.
+func (s *scheduler) after(entity string, fn func()) {
+	s.finalizers[entity] = append(s.finalizers[entity], fn)
+}
+
+// run runs all the scheduled imports and returns once they are all done.
+func (s *scheduler) run() {
+	done := make(map[string]chan struct{})
+	for _, entity := range entities {
+		done[entity] = make(chan struct{})
+	}
+
+	var wg sync.WaitGroup
+	for _, entity := range entities {
+		wg.Add(1)
+		go func(entity string) {
+			defer wg.Done()
+			defer close(done[entity])
+
+			for _, dep := range dependencies[entity] {
+				<-done[dep]
+			}
+			s.runEntity(entity)
+			for _, fn := range s.finalizers[entity] {
+				if aborted() {
+					return
+				}
+				fn()
+			}
+		}(entity)
+	}
+	wg.Wait()
+}
+
+// runEntity runs the imports of the dumps of the given entity.
+func (s *scheduler) runEntity(entity string) {
+	if !importers[entity].copyIn {
+		for _, task := range s.tasks[entity] {
+			s.sem <- struct{}{}
+			if !aborted() {
+				task()
+			}
+			<-s.sem
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, task := range s.tasks[entity] {
+		wg.Add(1)
+		s.sem <- struct{}{}
+		go func(task func()) {
+			defer wg.Done()
+			if !aborted() {
+				task()
+			}
+			<-s.sem
+		}(task)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,368 @@
+// Copyright 2014 The DevMine Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Regular expressions extracting the tables, columns and functions used by
+// the statements of the importers.
+//
+// Besides the columns listed by INSERT, COPY and UPDATE statements, the
+// columns of the other clauses are only extracted when they are qualified
+// with the name or the alias of their table, so the statements qualify all
+// the columns they use.
+var (
+	insertRegexp     = regexp.MustCompile(`(?i)INSERT INTO\s+(\w+)\s*\(([^)]*)\)`)
+	copyRegexp       = regexp.MustCompile(`(?i)COPY\s+"?(\w+)"?\s*\(([^)]*)\)`)
+	createTempRegexp = regexp.MustCompile(`(?i)CREATE TEMP TABLE\s+(\w+)`)
+	callRegexp       = regexp.MustCompile(`(?i)^SELECT\s+(\w+)\(\)$`)
+	updateRegexp     = regexp.MustCompile(`(?is)\bUPDATE\s+(\w+)(?:\s+AS\s+\w+)?\s+SET\s+(.+?)(?:\s+FROM\s|\s+WHERE\s|\s+RETURNING\s|$)`)
+	setColumnRegexp  = regexp.MustCompile(`(?:^|,)\s*"?(\w+)"?\s*=`)
+	tableRefRegexp   = regexp.MustCompile(`(?i)\b(FROM|JOIN|UPDATE|INTO)\s+(\w+)([.(]?)`)
+	aliasRegexp      = regexp.MustCompile(`(?i)^\s+(?:AS\s+)?(\w+)`)
+	subqueryRegexp   = regexp.MustCompile(`(?i)\)\s*(?:AS\s+)?(\w+)`)
+	cteRegexp        = regexp.MustCompile(`(?i)(?:\bWITH|,)\s*(\w+)\s+AS\s*\(`)
+	qualifiedRegexp  = regexp.MustCompile(`\b([A-Za-z_]\w*)\.([A-Za-z_]\w*)\b`)
+	literalRegexp    = regexp.MustCompile(`'(?:[^']|'')*'`)
+)
+
+// aliasKeywords are the keywords that may follow a table reference instead of
+// an alias.
+var aliasKeywords = map[string]bool{
+	"CROSS": true, "DO": true, "FULL": true, "GROUP": true, "INNER": true,
+	"JOIN": true, "LEFT": true, "LIMIT": true, "ON": true, "ORDER": true,
+	"RETURNING": true, "RIGHT": true, "SELECT": true, "SET": true,
+	"UNION": true, "USING": true, "VALUES": true, "WHERE": true,
+}
+
+// lookupQueries are the queries run by the importers, outside of their
+// prepared statements, to look up existing rows.
+var lookupQueries = []string{
+	fetchUserIDQuery,
+	fetchGhUserIDQuery,
+	fetchOrgIDQuery,
+	fetchGhUserIDFromLoginQuery,
+	fetchGhOrgIDFromLoginQuery,
+	fetchRepoIDQuery,
+	fetchRepoIDFromFullnameQuery,
+	orgMemberQuery,
+	repoCollaboQuery,
+	followerQuery,
+	watcherQuery,
+	githubIDQuery("gh_issues"),
+	githubIDQuery("gh_issue_comments"),
+	githubIDQuery("gh_issue_events"),
+	githubIDQuery("gh_pull_requests"),
+	githubIDQuery("gh_pull_request_comments"),
+	fetchIssueIDQuery,
+	fetchPullRequestIDQuery,
+}
+
+// schemaRequirements holds the tables, columns, constraints and functions of
+// the database schema that ght2dm relies on.
+type schemaRequirements struct {
+	columns     map[string]map[string]bool // columns by table
+	constraints map[string]map[string]bool // constraints by table
+	functions   map[string]bool
+
+	// optional are the staging tables that ght2dm creates when they do not
+	// exist, adding their missing columns when they do (see
+	// staging.prepare), and temp the temporary tables created by the
+	// importers. None of them is checked.
+	optional map[string]bool
+	temp     map[string]bool
+}
+
+// newSchemaRequirements collects the requirements of the importers of all the
+// GitHub entities and of the staging tables.
+func newSchemaRequirements() *schemaRequirements {
+	req := &schemaRequirements{
+		columns:     make(map[string]map[string]bool),
+		constraints: make(map[string]map[string]bool),
+		functions:   make(map[string]bool),
+		optional:    make(map[string]bool),
+		temp:        make(map[string]bool),
+	}
+
+	for _, entity := range entities {
+		imp := importerFor(entity)
+
+		for _, stmt := range imp.setup {
+			for _, m := range createTempRegexp.FindAllStringSubmatch(stmt, -1) {
+				req.temp[m[1]] = true
+			}
+		}
+		for _, stmts := range [][]string{imp.queries, imp.refresh, imp.merge, {imp.unresolved}} {
+			for _, stmt := range stmts {
+				req.addStatement(stmt)
+			}
+		}
+		for _, table := range imp.constrained {
+			req.addTable(table)
+		}
+	}
+	for _, query := range lookupQueries {
+		req.addStatement(query)
+	}
+
+	// In update mode, rows are upserted by GitHub ID.
+	if *update {
+		req.addConstraint("gh_users", "gh_users_unique_github_id")
+		req.addConstraint("gh_organizations", "gh_organizations_unique_github_id")
+		req.addConstraint("gh_repositories", "gh_repositories_unique_github_id")
+	}
+
+	// The merge functions of the staging tables are only required to exist:
+	// since migration 9, none of them alters constraints by name, so there is
+	// no constraint to check for them.
+	for _, st := range stagings {
+		req.optional[st.table] = true
+		for _, stmt := range append(st.mergeStmts(), st.unresolved) {
+			req.addStatement(stmt)
+		}
+	}
+
+	return req
+}
+
+// addStatement adds the tables, columns and functions used by the given
+// statement to the requirements.
+func (req *schemaRequirements) addStatement(stmt string) {
+	stmt = strings.TrimSpace(literalRegexp.ReplaceAllString(stmt, "''"))
+	if stmt == "" {
+		return
+	}
+	if m := callRegexp.FindStringSubmatch(stmt); m != nil {
+		req.functions[m[1]] = true
+		return
+	}
+
+	for _, m := range createTempRegexp.FindAllStringSubmatch(stmt, -1) {
+		req.temp[m[1]] = true
+	}
+	for _, m := range insertRegexp.FindAllStringSubmatch(stmt, -1) {
+		req.addColumns(m[1], m[2])
+	}
+	for _, m := range copyRegexp.FindAllStringSubmatch(stmt, -1) {
+		req.addColumns(m[1], m[2])
+	}
+	for _, m := range updateRegexp.FindAllStringSubmatch(stmt, -1) {
+		if strings.EqualFold(m[1], "SET") {
+			// ON CONFLICT DO UPDATE SET, whose columns are inserted.
+			continue
+		}
+		req.addTable(m[1])
+		for _, c := range setColumnRegexp.FindAllStringSubmatch(m[2], -1) {
+			req.columns[m[1]][c[1]] = true
+		}
+	}
+
+	// Resolve the qualified columns through the tables and aliases of the
+	// statement. Aliases given to several tables or to subqueries, as well
+	// as common table expressions, cannot be resolved and are ignored.
+	ctes := make(map[string]bool)
+	for _, m := range cteRegexp.FindAllStringSubmatch(stmt, -1) {
+		ctes[m[1]] = true
+	}
+	tables := make(map[string]bool)
+	aliases := make(map[string]string)
+	for _, loc := range tableRefRegexp.FindAllStringSubmatchIndex(stmt, -1) {
+		table := stmt[loc[4]:loc[5]]
+		if loc[6] != loc[7] && !strings.EqualFold(stmt[loc[2]:loc[3]], "INTO") {
+			// A function call or a qualified column, not a table.
+			continue
+		}
+		tables[table] = true
+
+		m := aliasRegexp.FindStringSubmatch(stmt[loc[1]:])
+		if m == nil || aliasKeywords[strings.ToUpper(m[1])] {
+			continue
+		}
+		if t, ok := aliases[m[1]]; ok && t != table {
+			aliases[m[1]] = ""
+		} else {
+			aliases[m[1]] = table
+		}
+	}
+	for _, m := range subqueryRegexp.FindAllStringSubmatch(stmt, -1) {
+		if _, ok := aliases[m[1]]; ok {
+			aliases[m[1]] = ""
+		}
+	}
+	for _, m := range qualifiedRegexp.FindAllStringSubmatch(stmt, -1) {
+		table, ok := aliases[m[1]]
+		if !ok && tables[m[1]] {
+			table = m[1]
+		}
+		if table == "" || ctes[table] {
+			continue
+		}
+		req.addTable(table)
+		req.columns[table][m[2]] = true
+	}
+}
+
+// addColumns adds the given comma separated list of columns of table to the
+// requirements.
+func (req *schemaRequirements) addColumns(table, columns string) {
+	if req.columns[table] == nil {
+		req.columns[table] = make(map[string]bool)
+	}
+	for _, col := range strings.Split(columns, ",") {
+		col = strings.Trim(strings.TrimSpace(col), `"`)
+		if col != "" {
+			req.columns[table][col] = true
+		}
+	}
+}
+
+// addTable adds the given table to the requirements.
+func (req *schemaRequirements) addTable(table string) {
+	if req.columns[table] == nil {
+		req.columns[table] = make(map[string]bool)
+	}
+}
+
+// addConstraint adds the given constraint of table to the requirements.
+func (req *schemaRequirements) addConstraint(table, constraint string) {
+	if req.constraints[table] == nil {
+		req.constraints[table] = make(map[string]bool)
+	}
+	req.constraints[table][constraint] = true
+}
+
+// checkSchema checks that all the tables, columns, constraints and functions
+// used by the importers exist in the database. All the mismatches are reported
+// at once, before any data is imported.
+func checkSchema() error {
+	req := newSchemaRequirements()
+
+	columns, err := fetchSchemaColumns()
+	if err != nil {
+		return err
+	}
+	constraints, err := fetchSchemaConstraints()
+	if err != nil {
+		return err
+	}
+	functions, err := fetchSchemaFunctions()
+	if err != nil {
+		return err
+	}
+
+	var mismatches []string
+	for table, cols := range req.columns {
+		if req.temp[table] || req.optional[table] {
+			continue
+		}
+		if columns[table] == nil {
+			mismatches = append(mismatches, fmt.Sprintf("missing table %s", table))
+			continue
+		}
+		for col := range cols {
+			if !columns[table][col] {
+				mismatches = append(mismatches, fmt.Sprintf("missing column %s.%s", table, col))
+			}
+		}
+	}
+	for table, cons := range req.constraints {
+		if columns[table] == nil {
+			// Already reported as a missing table.
+			continue
+		}
+		for con := range cons {
+			if !constraints[table][con] {
+				mismatches = append(mismatches, fmt.Sprintf("missing constraint %s on table %s", con, table))
+			}
+		}
+	}
+	for fn := range req.functions {
+		if !functions[fn] {
+			mismatches = append(mismatches, fmt.Sprintf("missing function %s()", fn))
+		}
+	}
+
+	if len(mismatches) == 0 {
+		return nil
+	}
+	sort.Strings(mismatches)
+	return errors.New("the database schema does not match the one expected by ght2dm:\n\t" +
+		strings.Join(mismatches, "\n\t"))
+}
+
+// fetchSchemaColumns returns the columns of the tables visible in the current
+// search path, by table.
+func fetchSchemaColumns() (map[string]map[string]bool, error) {
+	rows, err := db.Query(`
+		SELECT table_name, column_name
+		FROM information_schema.columns
+		WHERE table_schema = ANY(current_schemas(false))
+	`)
+	if err != nil {
+		return nil, err
+	}
+	return scanSchemaPairs(rows)
+}
+
+// fetchSchemaConstraints returns the constraints of the tables visible in the
+// current search path, by table.
+func fetchSchemaConstraints() (map[string]map[string]bool, error) {
+	rows, err := db.Query(`
+		SELECT rel.relname, con.conname
+		FROM pg_constraint AS con
+		INNER JOIN pg_class AS rel ON rel.oid = con.conrelid
+		WHERE pg_table_is_visible(rel.oid)
+	`)
+	if err != nil {
+		return nil, err
+	}
+	return scanSchemaPairs(rows)
+}
+
+// fetchSchemaFunctions returns the functions visible in the current search
+// path.
+func fetchSchemaFunctions() (map[string]bool, error) {
+	rows, err := db.Query("SELECT proname FROM pg_proc WHERE pg_function_is_visible(oid)")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fns := make(map[string]bool)
+	for rows.Next() {
+		var fn string
+		if err := rows.Scan(&fn); err != nil {
+			return nil, err
+		}
+		fns[fn] = true
+	}
+	return fns, rows.Err()
+}
+
+// scanSchemaPairs reads rows of (table, name) pairs and returns the names by
+// table.
+func scanSchemaPairs(rows *sql.Rows) (map[string]map[string]bool, error) {
+	defer rows.Close()
+
+	pairs := make(map[string]map[string]bool)
+	for rows.Next() {
+		var table, name string
+		if err := rows.Scan(&table, &name); err != nil {
+			return nil, err
+		}
+		if pairs[table] == nil {
+			pairs[table] = make(map[string]bool)
+		}
+		pairs[table][name] = true
+	}
+	return pairs, rows.Err()
+}
@@ -0,0 +1,129 @@
+// Copyright 2014 The DevMine Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAddStatement(t *testing.T) {
+	tests := []struct {
+		stmt string
+		want map[string]map[string]bool
+	}{
+		{
+			"UPDATE users SET username=$2, name=$3 WHERE users.id=$1",
+			map[string]map[string]bool{"users": {"username": true, "name": true, "id": true}},
+		},
+		{
+			`SELECT gh_followers.gh_user_id
+			FROM gh_followers
+			LEFT JOIN gh_users AS users ON users.id = gh_followers.gh_user_id
+			WHERE users.login = $1`,
+			map[string]map[string]bool{
+				"gh_followers": {"gh_user_id": true},
+				"gh_users":     {"id": true, "login": true},
+			},
+		},
+		{
+			// EXCLUDED is not a table and the columns of ON CONFLICT DO
+			// UPDATE SET are inserted.
+			`INSERT INTO gh_users(github_id,login) VALUES ($1,$2)
+			ON CONFLICT (github_id) DO UPDATE SET login=EXCLUDED.login
+			WHERE gh_users.updated_at < EXCLUDED.updated_at`,
+			map[string]map[string]bool{"gh_users": {"github_id": true, "login": true, "updated_at": true}},
+		},
+		{
+			// Common table expressions are not tables and aliases given to
+			// subqueries are not resolved.
+			`WITH tgu AS (
+				SELECT DISTINCT ON (github_id) * FROM tmp_gh_users
+			), refreshed AS (
+				UPDATE gh_users AS gu SET login = tgu.login
+				FROM tgu
+				WHERE gu.github_id = tgu.github_id
+				RETURNING gu.user_id, tgu.name
+			)
+			UPDATE users AS u
+			SET name = r.name
+			FROM refreshed AS r, (SELECT 1) AS gu
+			WHERE u.id = r.user_id AND u.email <> 'foo.bar'`,
+			map[string]map[string]bool{
+				"gh_users": {"login": true},
+				"users":    {"name": true, "id": true, "email": true},
+			},
+		},
+		{
+			`SELECT count(*) FROM tmp_gh_org_members AS tgom
+			WHERE NOT EXISTS (SELECT 1 FROM gh_users AS gu WHERE gu.login = tgom.login)`,
+			map[string]map[string]bool{
+				"tmp_gh_org_members": {"login": true},
+				"gh_users":           {"login": true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		req := &schemaRequirements{
+			columns:   make(map[string]map[string]bool),
+			functions: make(map[string]bool),
+			temp:      make(map[string]bool),
+		}
+		req.addStatement(tt.stmt)
+		if !reflect.DeepEqual(req.columns, tt.want) {
+			t.Errorf("columns of %q = %v, want %v", tt.stmt, req.columns, tt.want)
+		}
+	}
+}
+
+func TestSchemaRequirements(t *testing.T) {
+	defer func(b, u bool) { *bulk, *update = b, u }(*bulk, *update)
+
+	// Tables of the DevMine schema and of the ght2dm migrations.
+	tables := map[string]bool{
+		"users":                    true,
+		"gh_users":                 true,
+		"gh_organizations":         true,
+		"gh_users_organizations":   true,
+		"repositories":             true,
+		"gh_repositories":          true,
+		"users_repositories":       true,
+		"commits":                  true,
+		"gh_followers":             true,
+		"gh_stargazers":            true,
+		"gh_issues":                true,
+		"gh_issue_comments":        true,
+		"gh_issue_events":          true,
+		"gh_pull_requests":         true,
+		"gh_pull_request_comments": true,
+	}
+
+	// Columns only used by UPDATE statements or lookup queries.
+	columns := []struct{ table, column string }{
+		{"users", "username"},
+		{"gh_users", "user_id"},
+		{"gh_organizations", "login"},
+		{"gh_repositories", "full_name"},
+		{"gh_issues", "number"},
+		{"gh_pull_requests", "number"},
+		{"gh_pull_request_comments", "github_id"},
+	}
+
+	for _, b := range []bool{false, true} {
+		*bulk, *update = b, b
+		req := newSchemaRequirements()
+
+		for table := range req.columns {
+			if !req.temp[table] && !req.optional[table] && !tables[table] {
+				t.Errorf("bulk %t: unexpected table %s", b, table)
+			}
+		}
+		for _, c := range columns {
+			if !req.columns[c.table][c.column] {
+				t.Errorf("bulk %t: missing column %s.%s", b, c.table, c.column)
+			}
+		}
+	}
+}
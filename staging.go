@@ -0,0 +1,316 @@
+// Copyright 2014 The DevMine Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Kinds of staging tables
+const (
+	stagingTable    = "table"    // regular table
+	stagingUnlogged = "unlogged" // unlogged table, faster but not crash-safe
+	stagingTemp     = "temp"     // temporary table, dropped at the end of the run
+)
+
+// staging describes the staging table into which the documents of an entity
+// are imported before being merged into the DevMine tables.
+type staging struct {
+	table   string
+	columns string
+
+	// insert is the statement merging the staging table into the DevMine
+	// tables, which returns the number of rows inserted, and merge the
+	// statements executed after it. refresh is the statement executed before
+	// them in update mode, if any, which returns the number of rows
+	// refreshed. They call functions defined by the schema migrations.
+	insert  string
+	merge   []string
+	refresh string
+
+	// unresolved is the query returning, before insert, the origin of the
+	// rows that refer to entities missing from the database, and thus fail
+	// to be merged (see importer.unresolved).
+	unresolved string
+}
+
+// stagings maps the GitHub entities that are imported into a staging table to
+// their staging table.
+var stagings = map[string]*staging{
+	ghRepos: {
+		table: "tmp_gh_repositories",
+		columns: `
+			name character varying NOT NULL,
+			primary_language character varying NOT NULL,
+			clone_url character varying NOT NULL,
+			clone_path character varying NOT NULL,
+			vcs character varying NOT NULL,
+			github_id bigint NOT NULL,
+			full_name character varying,
+			description character varying,
+			homepage character varying,
+			fork boolean,
+			default_branch character varying,
+			master_branch character varying,
+			html_url character varying,
+			forks_count integer,
+			open_issues_count integer,
+			stargazers_count integer,
+			subscribers_count integer,
+			watchers_count integer,
+			size_in_kb integer,
+			created_at timestamp with time zone,
+			updated_at timestamp with time zone,
+			pushed_at timestamp with time zone,
+			parent_full_name character varying,
+			source_full_name character varying`,
+		insert:  "SELECT insert_repos()",
+		merge:   []string{"SELECT link_forks()"},
+		refresh: "SELECT refresh_repos()",
+	},
+	ghCommits: {
+		table: "tmp_gh_commits",
+		columns: `
+			repository_full_name character varying NOT NULL,
+			vcs_id character varying NOT NULL,
+			message text,
+			author_login character varying,
+			committer_login character varying,
+			author_date timestamp with time zone,
+			commit_date timestamp with time zone,
+			file_changed_count integer,
+			insertions_count integer,
+			deletions_count integer,
+			dump_name character varying,
+			dump_offset bigint,
+			document bytea`,
+		insert: "SELECT insert_commits()",
+		unresolved: `
+			SELECT tgc.dump_name, tgc.dump_offset, tgc.document
+			FROM tmp_gh_commits AS tgc
+			WHERE NOT EXISTS (SELECT 1 FROM gh_repositories AS gr WHERE gr.full_name = tgc.repository_full_name)`,
+	},
+}
+
+// checkStagingKind checks the kind of staging tables given on the command
+// line and adapts the database session to it.
+//
+// A temporary table only exists within the database connection that created
+// it, so a single connection, and thus a single writer, is used when staging
+// tables are temporary.
+func checkStagingKind() error {
+	switch *stagingKind {
+	case stagingTable, stagingUnlogged:
+	case stagingTemp:
+		db.SetMaxOpenConns(1)
+		*nbWriters = 1
+	default:
+		return errors.New("invalid kind of staging table " + *stagingKind)
+	}
+	return nil
+}
+
+// isTempStaged tells whether the given entity is imported into a temporary
+// staging table. The documents imported by a previous run into such a table
+// are lost, so dumps of the entity cannot be skipped or resumed.
+func isTempStaged(entity string) bool {
+	_, ok := stagings[entity]
+	return ok && *stagingKind == stagingTemp
+}
+
+// setupStagings prepares the staging tables of the entities scheduled by s
+// and schedules their merge once all the dumps of the entity are imported.
+func setupStagings(s *scheduler) error {
+	for _, entity := range entities {
+		st, ok := stagings[entity]
+		if !ok || len(s.tasks[entity]) == 0 {
+			continue
+		}
+
+		if err := st.prepare(); err != nil {
+			return fmt.Errorf("failed to prepare staging table %s: %v", st.table, err)
+		}
+
+		entity := entity
+		s.after(entity, func() {
+			fmt.Printf("[%s] merging '%s'\n", entity, st.table)
+			start := time.Now()
+			mc, err := st.finish(entity)
+			if err != nil {
+				fail(fmt.Sprintf("failed to merge staging table %s: %v", st.table, err))
+				importFailed(err)
+				mc = mergeCounts{} // the rows are left staged
+			}
+			report.merged(entity, time.Since(start), mc)
+
+			// The merge is committed, but the run is aborted all the same
+			// when the rows that failed to be merged exceed the error
+			// budget of the run.
+			if err := checkRunBudget(entity, report.runCounts(entity), true); err != nil {
+				fail(fmt.Sprintf("[%s] %v", entity, err))
+				importFailed(err)
+			}
+		})
+	}
+	return nil
+}
+
+// stagingMerged is the comment of the staging tables whose rows have been
+// merged and kept with -keepstaging.
+const stagingMerged = "merged by ght2dm"
+
+// prepare creates the staging table if it does not exist and empties it.
+//
+// Rows left by an interrupted run are merged before the table is emptied,
+// since the dumps they come from are considered as imported, unlike the rows
+// kept with -keepstaging, which have already been merged.
+func (st *staging) prepare() error {
+	txn, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	var stmts []string
+	switch *stagingKind {
+	case stagingTemp:
+		stmts = []string{fmt.Sprintf("CREATE TEMP TABLE IF NOT EXISTS %s (%s)", st.table, st.columns)}
+	case stagingUnlogged:
+		stmts = []string{
+			fmt.Sprintf("CREATE UNLOGGED TABLE IF NOT EXISTS %s (%s)", st.table, st.columns),
+			fmt.Sprintf("ALTER TABLE %s SET UNLOGGED", st.table),
+		}
+	default:
+		stmts = []string{
+			fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", st.table, st.columns),
+			fmt.Sprintf("ALTER TABLE %s SET LOGGED", st.table),
+		}
+	}
+	if err := execAll(txn, stmts); err != nil {
+		return err
+	}
+	if err := st.addMissingColumns(txn); err != nil {
+		return err
+	}
+
+	var comment string
+	err = txn.QueryRow("SELECT coalesce(obj_description($1::regclass, 'pg_class'), '')", st.table).Scan(&comment)
+	if err != nil {
+		return err
+	}
+	if comment == stagingMerged {
+		stmts = []string{"COMMENT ON TABLE " + st.table + " IS NULL"}
+	} else {
+		stmts = st.mergeStmts()
+	}
+	stmts = append(stmts, "TRUNCATE "+st.table)
+
+	if err := execAll(txn, stmts); err != nil {
+		return err
+	}
+	return txn.Commit()
+}
+
+// addMissingColumns adds the columns of the staging table that are missing
+// from an existing table, such as the tmp_gh_repositories table created by
+// the SQL scripts of the previous versions of ght2dm, so that documents can be
+// copied into it. The columns are added without their NOT NULL constraint,
+// which the rows already in the table would not satisfy.
+func (st *staging) addMissingColumns(txn *sql.Tx) error {
+	rows, err := txn.Query(`
+		SELECT attname
+		FROM pg_attribute
+		WHERE attrelid = $1::regclass AND attnum > 0 AND NOT attisdropped
+	`, st.table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	cols := make(map[string]bool)
+	for rows.Next() {
+		var col string
+		if err := rows.Scan(&col); err != nil {
+			return err
+		}
+		cols[col] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, def := range strings.Split(st.columns, ",") {
+		def = strings.TrimSpace(def)
+		if cols[strings.Fields(def)[0]] {
+			continue
+		}
+		def = strings.Replace(def, " NOT NULL", "", 1)
+		if _, err := txn.Exec("ALTER TABLE " + st.table + " ADD COLUMN " + def); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finish merges the staging table of the given entity into the DevMine
+// tables and, unless staging data must be kept, empties it. It returns the
+// counts of the rows merged. The rows failing to be merged are written to the
+// dead-letter file.
+func (st *staging) finish(entity string) (mergeCounts, error) {
+	var mc mergeCounts
+	txn, err := db.Begin()
+	if err != nil {
+		return mc, err
+	}
+	defer txn.Rollback()
+
+	if *update && st.refresh != "" {
+		if err := txn.QueryRow(st.refresh).Scan(&mc.refreshed); err != nil {
+			return mc, err
+		}
+	}
+	if err := txn.QueryRow("SELECT count(*) FROM " + st.table).Scan(&mc.staged); err != nil {
+		return mc, err
+	}
+	if st.unresolved != "" {
+		if mc.unresolved, err = deadLetterRows(txn, entity, st.unresolved); err != nil {
+			return mc, err
+		}
+	}
+	if err := txn.QueryRow(st.insert).Scan(&mc.merged); err != nil {
+		return mc, err
+	}
+	if err := execAll(txn, st.merge); err != nil {
+		return mc, err
+	}
+	// Kept rows are marked as merged so that the next run does not merge
+	// them again.
+	empty := "TRUNCATE " + st.table
+	if *keepStaging {
+		empty = "COMMENT ON TABLE " + st.table + " IS '" + stagingMerged + "'"
+	}
+	if _, err := txn.Exec(empty); err != nil {
+		return mc, err
+	}
+	if err := txn.Commit(); err != nil {
+		return mc, err
+	}
+	return mc, nil
+}
+
+// mergeStmts returns the statements merging the staging table, preceded in
+// update mode by the statements refreshing the existing rows.
+func (st *staging) mergeStmts() []string {
+	var stmts []string
+	if *update && st.refresh != "" {
+		stmts = append(stmts, st.refresh)
+	}
+	stmts = append(stmts, st.insert)
+	return append(stmts, st.merge...)
+}
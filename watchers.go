@@ -0,0 +1,89 @@
+// Copyright 2014 The DevMine Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// ghWatcher is a relation between a GitHub user and a repository the user
+// starred.
+type ghWatcher struct {
+	ID    int64  `bson:"id"`    // GitHub ID of the user
+	Login string `bson:"login"` // login of the user
+	Repo  string `bson:"repo"`  // name of the starred repository
+	Owner string `bson:"owner"` // login of the owner of the repository
+}
+
+// watchersFields are the fields of the gh_stargazers table.
+var watchersFields = []string{"gh_user_id", "repository_id"}
+
+// watchersImporter imports BSON dumps containing GitHub watchers (stargazers)
+// into the DevMine database.
+var watchersImporter = &importer{
+	constrained: []string{"gh_stargazers"},
+	queries:     []string{genInsQuery("gh_stargazers", watchersFields...)},
+	decode: func(bs []byte) (interface{}, error) {
+		ghw := ghWatcher{}
+		err := bson.Unmarshal(bs, &ghw)
+		return ghw, err
+	},
+	key: func(doc interface{}) string {
+		ghw := doc.(ghWatcher)
+		return ghw.Login + "\x00" + ghw.Owner + "/" + ghw.Repo
+	},
+	insert: func(txn *sql.Tx, stmts []*sql.Stmt, doc interface{}, o origin) error {
+		ghw := doc.(ghWatcher)
+		printVerbose("importing watcher with login", ghw.Login, ", owner", ghw.Owner, "and repo", ghw.Repo)
+		return insertWatcher(txn, stmts[0], ghw)
+	},
+}
+
+// watcherQuery is the query of insertWatcher checking whether a GitHub watcher
+// already exists.
+const watcherQuery = `
+	SELECT gh_stargazers.gh_user_id, gh_stargazers.repository_id
+	FROM gh_stargazers
+	LEFT JOIN gh_users ON gh_users.id = gh_stargazers.gh_user_id
+	LEFT JOIN gh_repositories ON gh_repositories.repository_id = gh_stargazers.repository_id
+	WHERE gh_users.login = $1 AND gh_repositories.full_name = $2`
+
+// insertWatcher inserts a GitHub watcher into the database.
+func insertWatcher(txn *sql.Tx, stmt *sql.Stmt, ghw ghWatcher) error {
+	fullname := ghw.Owner + "/" + ghw.Repo
+
+	if !*nocheck {
+		var ghUserID, repoID int64
+		err := txn.QueryRow(watcherQuery, ghw.Login, fullname).Scan(&ghUserID, &repoID)
+
+		switch {
+		case err == nil:
+			printVerbose(fmt.Sprintf("the gh_stargazers relation (%d, %d) already exists", ghUserID, repoID))
+			return errAlreadyExists // the relation already exist, no need to create it
+		case err != sql.ErrNoRows:
+			fail(err)
+			return fmt.Errorf("impossible to fetch watcher %s of %s", ghw.Login, fullname)
+		}
+	}
+
+	ghUserID := fetchGhUserIDFromLogin(txn, ghw.Login)
+	if ghUserID <= 0 {
+		return fmt.Errorf("failed to retrieve the id of the github user having the login %s", ghw.Login)
+	}
+
+	repoID := fetchRepoIDFromFullname(txn, fullname)
+	if repoID <= 0 {
+		return fmt.Errorf("failed to retrieve the id of the repository having the full name %s", fullname)
+	}
+
+	if _, err := stmt.Exec(ghUserID, repoID); err != nil {
+		fail(err)
+		return fmt.Errorf("impossible to insert watcher %s of %s", ghw.Login, fullname)
+	}
+	return nil
+}